@@ -0,0 +1,56 @@
+package sync
+
+// CanonicalKVMap is a concurrent map with string keys that are normalized before
+// every access, so that keys differing only in spelling, such as "Content-Type" and
+// "content-type", share one entry.
+//
+// The normalization is the canon function passed to NewCanonicalKVMap, for instance
+// strings.ToLower or textproto.CanonicalMIMEHeaderKey. It must be idempotent. The
+// map stores and reports canonical keys only, so Range yields canon(key) rather than
+// the spelling used by the Store that created the entry.
+//
+// A CanonicalKVMap must be created with NewCanonicalKVMap and must not be copied
+// after first use. It is a thin layer over a KVMap and has the same semantics
+// otherwise.
+type CanonicalKVMap[V any] struct {
+	canon func(string) string
+	m     KVMap[string, V]
+}
+
+// NewCanonicalKVMap returns an empty CanonicalKVMap that normalizes keys with canon.
+func NewCanonicalKVMap[V any](canon func(string) string) *CanonicalKVMap[V] {
+	return &CanonicalKVMap[V]{canon: canon}
+}
+
+// Load returns the value stored for the canonical form of key, like KVMap.Load.
+func (m *CanonicalKVMap[V]) Load(key string) (value *V, ok bool) {
+	return m.m.Load(m.canon(key))
+}
+
+// Store sets the value for the canonical form of key, like KVMap.Store.
+func (m *CanonicalKVMap[V]) Store(key string, value *V) {
+	m.m.Store(m.canon(key), value)
+}
+
+// LoadOrStore returns the existing value for the canonical form of key or stores
+// value, like KVMap.LoadOrStore.
+func (m *CanonicalKVMap[V]) LoadOrStore(key string, value *V) (actual *V, loaded bool) {
+	return m.m.LoadOrStore(m.canon(key), value)
+}
+
+// LoadAndDelete deletes the entry for the canonical form of key and returns its
+// value, like KVMap.LoadAndDelete.
+func (m *CanonicalKVMap[V]) LoadAndDelete(key string) (value *V, loaded bool) {
+	return m.m.LoadAndDelete(m.canon(key))
+}
+
+// Delete removes the entry for the canonical form of key, like KVMap.Delete.
+func (m *CanonicalKVMap[V]) Delete(key string) {
+	m.m.Delete(m.canon(key))
+}
+
+// Range calls f sequentially for each canonical key and value present in the map. If
+// f returns false, the iteration stops. It has the same semantics as KVMap.Range.
+func (m *CanonicalKVMap[V]) Range(f func(key string, value *V) bool) {
+	m.m.Range(f)
+}
@@ -0,0 +1,35 @@
+package sync
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCanonicalKVMap(t *testing.T) {
+	m := NewCanonicalKVMap[string](strings.ToLower)
+	mime := "application/json"
+	m.Store("Content-Type", &mime)
+
+	if v, ok := m.Load("content-type"); !ok || *v != mime {
+		t.Fatalf("Load(content-type) = %v, %v; want the value stored under Content-Type", v, ok)
+	}
+
+	text := "text/plain"
+	if actual, loaded := m.LoadOrStore("CONTENT-TYPE", &text); !loaded || *actual != mime {
+		t.Fatalf("LoadOrStore(CONTENT-TYPE) = %v, %v; want the existing value", *actual, loaded)
+	}
+
+	m.Range(func(k string, _ *string) bool {
+		if k != "content-type" {
+			t.Errorf("Range yielded %q, want the canonical key", k)
+		}
+		return true
+	})
+
+	if _, loaded := m.LoadAndDelete("content-TYPE"); !loaded {
+		t.Fatal("LoadAndDelete through another spelling missed the entry")
+	}
+	if _, ok := m.Load("Content-Type"); ok {
+		t.Fatal("entry survived LoadAndDelete")
+	}
+}
@@ -0,0 +1,124 @@
+package sync
+
+import (
+	"sync"
+	"time"
+)
+
+// CoalescingKVMap buffers writes to a KVMap and applies them in batches, keeping
+// only the most recent value stored for each key since the previous batch.
+//
+// It suits feeds that update the same keys far more often than anyone needs to
+// observe them, such as sensor readings: a thousand Stores to one key between two
+// flushes cost a single update of the underlying map instead of a thousand atomic
+// swaps on its entry.
+//
+// Pending writes are applied by Flush, by a background goroutine running at the
+// interval given to NewCoalescingKVMap, and by Close. Readers that need the latest
+// buffered value use Load; readers of the underlying KVMap only see what has been
+// flushed. A CoalescingKVMap is safe for concurrent use, must be created with
+// NewCoalescingKVMap, and should be closed when no longer needed.
+type CoalescingKVMap[K comparable, V any] struct {
+	target *KVMap[K, V]
+
+	mu      sync.Mutex
+	pending map[K]*V
+
+	flushMu sync.Mutex
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewCoalescingKVMap returns a CoalescingKVMap that applies its writes to target.
+//
+// If interval is positive, a background goroutine flushes pending writes every
+// interval until Close is called. Otherwise writes are only applied by explicit
+// calls to Flush or Close.
+func NewCoalescingKVMap[K comparable, V any](target *KVMap[K, V], interval time.Duration) *CoalescingKVMap[K, V] {
+	c := &CoalescingKVMap[K, V]{
+		target:  target,
+		pending: make(map[K]*V),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if interval <= 0 {
+		close(c.done)
+		return c
+	}
+
+	go func() {
+		defer close(c.done)
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				c.Flush()
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+// Store records value as the pending value for key, replacing any value buffered for
+// it since the last flush. As with KVMap.Store, a nil value deletes the key once
+// flushed.
+func (c *CoalescingKVMap[K, V]) Store(key K, value *V) {
+	c.mu.Lock()
+	c.pending[key] = value
+	c.mu.Unlock()
+}
+
+// Load returns the value for key, preferring a pending write over the value in the
+// underlying map. A pending deletion makes the key absent. While a flush is being
+// applied, Load may briefly return the value the key had before that flush.
+func (c *CoalescingKVMap[K, V]) Load(key K) (value *V, ok bool) {
+	c.mu.Lock()
+	value, ok = c.pending[key]
+	c.mu.Unlock()
+
+	if ok {
+		return value, value != nil
+	}
+
+	return c.target.Load(key)
+}
+
+// Flush applies every pending write to the underlying map.
+//
+// Flushes are serialized, so a batch is never overtaken by a newer one: after Flush
+// returns, every write stored before the call has reached the underlying map, and
+// the map holds the most recent value for each key.
+func (c *CoalescingKVMap[K, V]) Flush() {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.mu.Lock()
+	batch := c.pending
+	c.pending = make(map[K]*V, len(batch))
+	c.mu.Unlock()
+
+	for k, v := range batch {
+		c.target.Store(k, v)
+	}
+}
+
+// Close stops the background flusher, if any, and flushes the pending writes. Stores
+// made after Close are buffered until the next explicit Flush. Close may be called
+// more than once.
+func (c *CoalescingKVMap[K, V]) Close() {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		<-c.done
+	})
+
+	c.Flush()
+}
@@ -0,0 +1,67 @@
+package sync
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCoalescingKVMapKeepsLastValue(t *testing.T) {
+	var target KVMap[string, int]
+	c := NewCoalescingKVMap(&target, 0)
+	defer c.Close()
+
+	var last *int
+	for i := 0; i < 1000; i++ {
+		i := i
+		last = &i
+		c.Store("sensor", last)
+	}
+
+	if _, ok := target.Load("sensor"); ok {
+		t.Fatal("a write reached the target before any flush")
+	}
+	if v, ok := c.Load("sensor"); !ok || v != last {
+		t.Fatalf("Load before the flush = %v, %v; want the pending value", v, ok)
+	}
+
+	c.Flush()
+	if v, ok := target.Load("sensor"); !ok || v != last || *v != 999 {
+		t.Fatalf("target after Flush = %v, %v; want the last value, 999", v, ok)
+	}
+
+	c.Store("sensor", nil)
+	if _, ok := c.Load("sensor"); ok {
+		t.Fatal("a pending deletion did not hide the key")
+	}
+	c.Flush()
+	if _, ok := target.Load("sensor"); ok {
+		t.Fatal("a flushed deletion left the key in the target")
+	}
+}
+
+func TestCoalescingKVMapBackgroundFlush(t *testing.T) {
+	var target KVMap[string, int]
+	c := NewCoalescingKVMap(&target, time.Millisecond)
+
+	v := 1
+	c.Store("k", &v)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if got, ok := target.Load("k"); ok && got == &v {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the background flusher never applied the write")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	w := 2
+	c.Store("k", &w)
+	c.Close()
+	c.Close()
+	if got, _ := target.Load("k"); got != &w {
+		t.Fatal("Close did not flush the pending write")
+	}
+}
@@ -0,0 +1,26 @@
+//go:build kvmapdebug
+
+package sync
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// copyChecker detects a KVMap that was copied after first use. The first method
+// call records the checker's own address; a later call through a copy finds a
+// different address recorded and panics.
+//
+// It is only compiled into builds with the kvmapdebug tag, where every call pays
+// for an extra atomic load. Like the check of sync.Cond, it relies on the map not
+// being moved by the runtime, which holds for maps on the heap.
+type copyChecker struct {
+	addr atomic.Uintptr
+}
+
+func (c *copyChecker) check() {
+	self := uintptr(unsafe.Pointer(c))
+	if c.addr.Load() != self && !c.addr.CompareAndSwap(0, self) && c.addr.Load() != self {
+		panic("sync: KVMap copied after first use")
+	}
+}
@@ -0,0 +1,45 @@
+//go:build kvmapdebug
+
+package sync
+
+import (
+	"reflect"
+	"testing"
+)
+
+// copyOf returns a copy of *m, made through reflection so that vet's copylocks
+// check does not reject the test itself.
+func copyOf[K comparable, V any](m *KVMap[K, V]) *KVMap[K, V] {
+	c := reflect.New(reflect.TypeOf(m).Elem())
+	c.Elem().Set(reflect.ValueOf(m).Elem())
+
+	return c.Interface().(*KVMap[K, V])
+}
+
+func TestCopyCheckPanicsOnCopiedMap(t *testing.T) {
+	m := new(KVMap[string, int])
+	one := 1
+	m.Store("k", &one)
+
+	c := copyOf(m)
+
+	defer func() {
+		if r := recover(); r != "sync: KVMap copied after first use" {
+			t.Fatalf("recovered %v, want the copy-after-use panic", r)
+		}
+	}()
+	c.Load("k")
+	t.Fatal("using a copied map did not panic")
+}
+
+func TestCopyCheckAllowsCopyBeforeUse(t *testing.T) {
+	m := new(KVMap[string, int])
+	c := copyOf(m)
+
+	one := 1
+	c.Store("k", &one)
+	m.Store("k", &one)
+	if v, ok := c.Load("k"); !ok || v != &one {
+		t.Fatal("a map copied before first use does not work")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !kvmapdebug
+
+package sync
+
+// copyChecker detects a KVMap that was copied after first use. It only checks
+// anything when built with the kvmapdebug build tag; see copy-check-debug.go.
+type copyChecker struct{}
+
+func (c *copyChecker) check() {}
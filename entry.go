@@ -1,6 +1,9 @@
 package sync
 
-import "sync/atomic"
+import (
+	"sync/atomic"
+	"unsafe"
+)
 
 // An entry is a slot in the map corresponding to a particular key.
 type entry[T any] struct {
@@ -23,21 +26,34 @@ type entry[T any] struct {
 	// p != expunged. If p == expunged, an entry's associated value can be updated
 	// only after first setting m.dirty[key] = e so that lookups using the dirty
 	// map find the entry.
-	p atomic.Pointer[T]
+	//
+	// p is an unsafe.Pointer rather than an atomic.Pointer[T] so that expunged is
+	// never converted to *T: it points to an allocation unrelated to T, and the
+	// conversion would be rejected by checkptr whenever T is larger than it. Only
+	// pointers known to be neither nil nor expunged are converted, by value.
+	p unsafe.Pointer
+}
+
+// loadP atomically loads e.p.
+func (e *entry[T]) loadP() unsafe.Pointer {
+	return atomic.LoadPointer(&e.p)
+}
+
+// casP atomically replaces e.p with new if it is old.
+func (e *entry[T]) casP(old, new unsafe.Pointer) bool {
+	return atomic.CompareAndSwapPointer(&e.p, old, new)
 }
 
 func newEntry[T any](i *T) *entry[T] {
-	e := &entry[T]{}
-	e.p.Store(i)
-	return e
+	return &entry[T]{p: unsafe.Pointer(i)}
 }
 
 func (e *entry[T]) load() (value *T, ok bool) {
-	p := e.p.Load()
-	if p == nil || p == (*T)(expunged) {
+	p := e.loadP()
+	if p == nil || p == expunged {
 		return nil, false
 	}
-	return p, true
+	return (*T)(p), true
 }
 
 // tryCompareAndSwap compare the entry with the given old value and swaps
@@ -47,8 +63,8 @@ func (e *entry[T]) load() (value *T, ok bool) {
 // If the entry is expunged, tryCompareAndSwap returns false and leaves
 // the entry unchanged.
 func (e *entry[T]) tryCompareAndSwap(old, new *T) bool {
-	p := e.p.Load()
-	if p == nil || p == (*T)(expunged) || p != old {
+	p := e.loadP()
+	if p == nil || p == expunged || p != unsafe.Pointer(old) {
 		return false
 	}
 
@@ -57,29 +73,44 @@ func (e *entry[T]) tryCompareAndSwap(old, new *T) bool {
 	// bother heap-allocating an interface value to store.
 	nc := new
 	for {
-		if e.p.CompareAndSwap(p, nc) {
+		if e.casP(p, unsafe.Pointer(nc)) {
 			return true
 		}
-		p = e.p.Load()
-		if p == nil || p == (*T)(expunged) || p != old {
+		p = e.loadP()
+		if p == nil || p == expunged || p != unsafe.Pointer(old) {
 			return false
 		}
 	}
 }
 
+// tryCompareAndDelete deletes the entry's value if it is old, and reports whether
+// it did. A nil old never matches.
+func (e *entry[T]) tryCompareAndDelete(old *T) bool {
+	for {
+		p := e.loadP()
+		if p == nil || p == expunged || p != unsafe.Pointer(old) {
+			return false
+		}
+
+		if e.casP(p, nil) {
+			return true
+		}
+	}
+}
+
 // unexpungeLocked ensures that the entry is not marked as expunged.
 //
 // If the entry was previously expunged, it must be added to the dirty map
 // before m.mu is unlocked.
 func (e *entry[T]) unexpungeLocked() (wasExpunged bool) {
-	return e.p.CompareAndSwap((*T)(expunged), nil)
+	return e.casP(expunged, nil)
 }
 
 // swapLocked unconditionally swaps a value into the entry.
 //
 // The entry must be known not to be expunged.
 func (e *entry[T]) swapLocked(i *T) *T {
-	return e.p.Swap(i)
+	return (*T)(atomic.SwapPointer(&e.p, unsafe.Pointer(i)))
 }
 
 // tryLoadOrStore atomically loads or stores a value if the entry is not
@@ -88,12 +119,12 @@ func (e *entry[T]) swapLocked(i *T) *T {
 // If the entry is expunged, tryLoadOrStore leaves the entry unchanged and
 // returns with ok==false.
 func (e *entry[T]) tryLoadOrStore(i *T) (actual *T, loaded, ok bool) {
-	p := e.p.Load()
-	if p == (*T)(expunged) {
+	p := e.loadP()
+	if p == expunged {
 		return nil, false, false
 	}
 	if p != nil {
-		return p, true, true
+		return (*T)(p), true, true
 	}
 
 	// Copy the interface after the first load to make this method more amenable
@@ -101,27 +132,27 @@ func (e *entry[T]) tryLoadOrStore(i *T) (actual *T, loaded, ok bool) {
 	// shouldn't bother heap-allocating.
 	ic := i
 	for {
-		if e.p.CompareAndSwap(nil, ic) {
+		if e.casP(nil, unsafe.Pointer(ic)) {
 			return i, false, true
 		}
-		p = e.p.Load()
-		if p == (*T)(expunged) {
+		p = e.loadP()
+		if p == expunged {
 			return nil, false, false
 		}
 		if p != nil {
-			return p, true, true
+			return (*T)(p), true, true
 		}
 	}
 }
 
 func (e *entry[T]) delete() (value *T, ok bool) {
 	for {
-		p := e.p.Load()
-		if p == nil || p == (*T)(expunged) {
+		p := e.loadP()
+		if p == nil || p == expunged {
 			return nil, false
 		}
-		if e.p.CompareAndSwap(p, nil) {
-			return p, true
+		if e.casP(p, nil) {
+			return (*T)(p), true
 		}
 	}
 }
@@ -132,24 +163,42 @@ func (e *entry[T]) delete() (value *T, ok bool) {
 // unchanged.
 func (e *entry[T]) trySwap(i *T) (*T, bool) {
 	for {
-		p := e.p.Load()
-		if p == (*T)(expunged) {
+		p := e.loadP()
+		if p == expunged {
 			return nil, false
 		}
-		if e.p.CompareAndSwap(p, i) {
-			return p, true
+		if e.casP(p, unsafe.Pointer(i)) {
+			return (*T)(p), true
 		}
 	}
 }
 
 func (e *entry[T]) tryExpungeLocked() (isExpunged bool) {
-	p := e.p.Load()
+	p := e.loadP()
 	for p == nil {
-		if e.p.CompareAndSwap(nil, (*T)(expunged)) {
+		if e.casP(nil, expunged) {
 			return true
 		}
-		p = e.p.Load()
+		p = e.loadP()
 	}
 
-	return p == (*T)(expunged)
+	return p == expunged
+}
+
+// detachLocked unconditionally marks the entry as expunged and returns the value it
+// held, if any. Once detached, the entry rejects every further update, so it must
+// be dropped from both the read-only and the dirty map before m.mu is unlocked.
+func (e *entry[T]) detachLocked() (value *T, ok bool) {
+	for {
+		p := e.loadP()
+		if p == expunged {
+			return nil, false
+		}
+		if e.casP(p, expunged) {
+			if p == nil {
+				return nil, false
+			}
+			return (*T)(p), true
+		}
+	}
 }
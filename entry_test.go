@@ -0,0 +1,96 @@
+package sync
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// large is bigger than the allocation expunged points to, so converting the
+// sentinel to *large is rejected by checkptr under -race.
+type large struct {
+	a, b, c, d int64
+}
+
+// churn stores, loads and deletes keys from several goroutines, forcing entries
+// through promotion and expunging.
+func churn(t *testing.T, store func(k int), load func(k int), del func(k int)) {
+	t.Helper()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				k := (i + w) % 64
+				store(k)
+				load(k)
+				load(k + 1)
+				if i%3 == 0 {
+					del(k)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestEntryLargeValue(t *testing.T) {
+	var m KVMap[int, large]
+	churn(t,
+		func(k int) { m.Store(k, &large{a: int64(k)}) },
+		func(k int) {
+			if v, ok := m.Load(k); ok && v.a != int64(k) {
+				t.Errorf("Load(%d) = %d", k, v.a)
+			}
+		},
+		func(k int) {
+			if v, ok := m.Load(k); ok {
+				m.CompareAndDelete(k, v)
+			}
+			m.Delete(k)
+		},
+	)
+
+	m.Range(func(k int, v *large) bool {
+		if v.a != int64(k) {
+			t.Errorf("Range: %d = %d", k, v.a)
+		}
+		return true
+	})
+}
+
+func TestEntryEqVMap(t *testing.T) {
+	m := NewEqVMap[int](WithKeyHash(func(k any) uint64 { return uint64(k.(int) % 8) }))
+	churn(t,
+		func(k int) { m.Store(k, &k) },
+		func(k int) {
+			if v, ok := m.Load(k); ok && *v != k {
+				t.Errorf("Load(%d) = %d", k, *v)
+			}
+		},
+		func(k int) { m.Delete(k) },
+	)
+}
+
+func TestEntryZeroSizeValue(t *testing.T) {
+	var s Set[string]
+	for i := 0; i < 100; i++ {
+		k := strconv.Itoa(i)
+		if !s.Add(k) {
+			t.Fatalf("Add(%q) = false for a new element", k)
+		}
+		if !s.Remove(k) {
+			t.Fatalf("Remove(%q) = false for a present element", k)
+		}
+		if !s.Add(k) {
+			t.Fatalf("Add(%q) = false after Remove", k)
+		}
+	}
+
+	if n := s.Len(); n != 100 {
+		t.Fatalf("Len() = %d, want 100", n)
+	}
+}
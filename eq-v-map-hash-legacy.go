@@ -0,0 +1,9 @@
+//go:build !go1.24
+
+package sync
+
+// defaultKeyHash reports that there is no default hash for an EqVMap before Go
+// 1.24, which introduced maphash.Comparable.
+func defaultKeyHash() func(key any) uint64 {
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build go1.24
+
+package sync
+
+import "hash/maphash"
+
+// defaultKeyHash returns the hash of an EqVMap whose keys are compared with ==. It
+// hashes the dynamic value of a key, consistently with ==, with a seed of its own.
+func defaultKeyHash() func(key any) uint64 {
+	seed := maphash.MakeSeed()
+
+	return func(key any) uint64 {
+		return maphash.Comparable(seed, key)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build go1.24
+
+package sync
+
+import "testing"
+
+func TestEqVMapDefaultHash(t *testing.T) {
+	m := NewEqVMap[int]()
+	for i := 0; i < 100; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+
+	for i := 0; i < 100; i++ {
+		if v, ok := m.Load(i); !ok || *v != i {
+			t.Fatalf("Load(%d) = %v, %v", i, v, ok)
+		}
+	}
+
+	if n := m.buckets.Len(); n < 50 {
+		t.Fatalf("100 keys landed in %d buckets", n)
+	}
+}
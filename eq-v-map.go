@@ -0,0 +1,234 @@
+package sync
+
+// EqVMap is a concurrent map with type-safe values and keys of any type, like VMap,
+// except that keys are matched with a caller-supplied equality function instead of
+// Go's == on interfaces.
+//
+// With VMap, pointer keys compare by identity, so two distinct pointers to equal
+// structs are two different keys. EqVMap lets the caller decide: with an equality
+// that compares what the pointers point to, both find the same entry. Keys are
+// grouped into buckets by a hash function, and matched with the equality function
+// within their bucket. Both are set with options passed to NewEqVMap:
+//
+//	m := NewEqVMap[Session](
+//		WithKeyEqual(func(a, b any) bool { return *a.(*UserID) == *b.(*UserID) }),
+//		WithKeyHash(func(k any) uint64 { return uint64(*k.(*UserID)) }),
+//	)
+//
+// The hash must agree with the equality: keys that are equal must hash alike. If
+// WithKeyEqual is given without WithKeyHash, no such hash is known, so every key is
+// given the same one and the map becomes a single bucket: it still works, but each
+// lookup compares the key with every entry and each write copies them all, so it is
+// only suitable for small maps. Give WithKeyHash for anything larger. Without
+// WithKeyEqual, keys are compared with ==, as in VMap, and hashed with
+// maphash.Comparable unless WithKeyHash is given; before Go 1.24, which introduced
+// it, a map without WithKeyEqual requires WithKeyHash.
+//
+// Each bucket is an immutable slice of entries, replaced as a whole by
+// compare-and-swap on every write, so EqVMap works best when buckets stay small.
+// Values are stored as *V pointers and a nil *V is treated as no value. An EqVMap
+// must be created with NewEqVMap and must not be copied after first use.
+type EqVMap[T any] struct {
+	eq      func(a, b any) bool
+	hash    func(key any) uint64
+	buckets KVMap[uint64, []eqPair[T]]
+}
+
+// eqPair is an entry of an EqVMap bucket.
+type eqPair[T any] struct {
+	key   any
+	value *T
+}
+
+// EqOption configures an EqVMap created by NewEqVMap.
+type EqOption func(*eqOptions)
+
+type eqOptions struct {
+	eq   func(a, b any) bool
+	hash func(key any) uint64
+}
+
+// WithKeyEqual makes an EqVMap match keys with eq. eq must be an equivalence
+// relation and must be consistent with the hash set by WithKeyHash. Without
+// WithKeyHash, all keys share one bucket and operations are O(n).
+func WithKeyEqual(eq func(a, b any) bool) EqOption {
+	return func(o *eqOptions) {
+		o.eq = eq
+	}
+}
+
+// WithKeyHash makes an EqVMap group keys into buckets by hash. Keys that are equal
+// according to WithKeyEqual must have the same hash.
+func WithKeyHash(hash func(key any) uint64) EqOption {
+	return func(o *eqOptions) {
+		o.hash = hash
+	}
+}
+
+// NewEqVMap returns an empty EqVMap configured by opts. Before Go 1.24, it panics if
+// opts contain neither WithKeyHash nor WithKeyEqual.
+func NewEqVMap[T any](opts ...EqOption) *EqVMap[T] {
+	var o eqOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.hash == nil {
+		if o.eq != nil {
+			o.hash = func(any) uint64 { return 0 }
+		} else if o.hash = defaultKeyHash(); o.hash == nil {
+			panic("sync: NewEqVMap requires WithKeyHash before Go 1.24")
+		}
+	}
+
+	if o.eq == nil {
+		o.eq = func(a, b any) bool { return a == b }
+	}
+
+	return &EqVMap[T]{eq: o.eq, hash: o.hash}
+}
+
+// Load returns the value stored for a key equal to key, or nil if there is none.
+func (m *EqVMap[T]) Load(key any) (value *T, ok bool) {
+	b, ok := m.buckets.Load(m.hash(key))
+	if !ok {
+		return nil, false
+	}
+
+	if i := m.index(*b, key); i >= 0 {
+		return (*b)[i].value, true
+	}
+
+	return nil, false
+}
+
+// Store sets the value for key, replacing the value of any equal key already in the
+// map. The key kept in the map is the one stored first. A nil value deletes the key.
+func (m *EqVMap[T]) Store(key any, value *T) {
+	_, _ = m.Swap(key, value)
+}
+
+// LoadOrStore returns the value stored for a key equal to key if there is one.
+// Otherwise, it stores value under key and returns it. The loaded result reports
+// whether the value was already present. A nil value is returned but not stored.
+func (m *EqVMap[T]) LoadOrStore(key any, value *T) (actual *T, loaded bool) {
+	h := m.hash(key)
+
+	for {
+		b, ok := m.buckets.Load(h)
+		if ok {
+			if i := m.index(*b, key); i >= 0 {
+				return (*b)[i].value, true
+			}
+		}
+
+		if value == nil {
+			return nil, false
+		}
+
+		if m.replace(h, b, ok, key, value) {
+			return value, false
+		}
+	}
+}
+
+// LoadAndDelete deletes the entry for a key equal to key, returning the value that
+// was present and whether there was one.
+func (m *EqVMap[T]) LoadAndDelete(key any) (value *T, loaded bool) {
+	return m.Swap(key, nil)
+}
+
+// Delete removes the entry for a key equal to key.
+func (m *EqVMap[T]) Delete(key any) {
+	_, _ = m.Swap(key, nil)
+}
+
+// Swap stores value for key and returns the previous value, if any. A nil value
+// deletes the key.
+func (m *EqVMap[T]) Swap(key any, value *T) (previous *T, loaded bool) {
+	h := m.hash(key)
+
+	for {
+		b, ok := m.buckets.Load(h)
+
+		previous, loaded = nil, false
+		if ok {
+			if i := m.index(*b, key); i >= 0 {
+				previous, loaded = (*b)[i].value, true
+			}
+		}
+
+		if !loaded && value == nil {
+			return nil, false
+		}
+
+		if m.replace(h, b, ok, key, value) {
+			return previous, loaded
+		}
+	}
+}
+
+// Range calls f sequentially for each key and value present in the map. If f
+// returns false, the iteration stops. Each bucket is visited as it was when Range
+// reached it; otherwise it has the semantics of VMap.Range.
+func (m *EqVMap[T]) Range(f func(key any, value *T) bool) {
+	m.buckets.Range(func(_ uint64, b *[]eqPair[T]) bool {
+		for _, p := range *b {
+			if !f(p.key, p.value) {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+// index returns the position of the entry matching key in b, or -1.
+func (m *EqVMap[T]) index(b []eqPair[T], key any) int {
+	for i, p := range b {
+		if m.eq(p.key, key) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// replace installs a copy of bucket h, as loaded into old (present if ok), in which
+// key holds value, or is removed if value is nil. It reports false if the bucket
+// changed since it was loaded.
+func (m *EqVMap[T]) replace(h uint64, old *[]eqPair[T], ok bool, key any, value *T) bool {
+	var cur []eqPair[T]
+	if ok {
+		cur = *old
+	}
+
+	next := make([]eqPair[T], 0, len(cur)+1)
+	found := false
+	for _, p := range cur {
+		if !found && m.eq(p.key, key) {
+			found = true
+			if value != nil {
+				next = append(next, eqPair[T]{key: p.key, value: value})
+			}
+
+			continue
+		}
+
+		next = append(next, p)
+	}
+
+	if !found && value != nil {
+		next = append(next, eqPair[T]{key: key, value: value})
+	}
+
+	switch {
+	case !ok:
+		_, loaded := m.buckets.LoadOrStore(h, &next)
+		return !loaded
+	case len(next) == 0:
+		return m.buckets.CompareAndDelete(h, old)
+	default:
+		return m.buckets.CompareAndSwap(h, old, &next)
+	}
+}
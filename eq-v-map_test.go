@@ -0,0 +1,109 @@
+package sync
+
+import (
+	"sync"
+	"testing"
+)
+
+type userID int
+
+func TestEqVMapCustomEquality(t *testing.T) {
+	m := NewEqVMap[string](
+		WithKeyEqual(func(a, b any) bool { return *a.(*userID) == *b.(*userID) }),
+		WithKeyHash(func(k any) uint64 { return uint64(*k.(*userID)) }),
+	)
+
+	a, b := userID(7), userID(7)
+	v := "session"
+	m.Store(&a, &v)
+
+	if got, ok := m.Load(&b); !ok || *got != v {
+		t.Fatalf("Load(&b) = %v, %v; want the value stored under &a", got, ok)
+	}
+
+	w := "other"
+	if actual, loaded := m.LoadOrStore(&b, &w); !loaded || *actual != v {
+		t.Fatalf("LoadOrStore(&b) = %v, %v; want the existing value", *actual, loaded)
+	}
+
+	m.Delete(&b)
+	if _, ok := m.Load(&a); ok {
+		t.Fatal("Delete(&b) left the entry of &a")
+	}
+}
+
+func TestEqVMapEqualWithoutHash(t *testing.T) {
+	// Without WithKeyHash every key lands in the same bucket, where the comparator
+	// alone tells them apart.
+	m := NewEqVMap[int](WithKeyEqual(func(a, b any) bool { return *a.(*userID) == *b.(*userID) }))
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				id, v := userID(i), i
+				m.Store(&id, &v)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 20; i++ {
+		id := userID(i)
+		if v, ok := m.Load(&id); !ok || *v != i {
+			t.Fatalf("Load(&%d) = %v, %v; want %d", i, v, ok, i)
+		}
+	}
+
+	id := userID(3)
+	m.Delete(&id)
+	n := 0
+	m.Range(func(any, *int) bool {
+		n++
+		return true
+	})
+	if n != 19 {
+		t.Fatalf("Range visited %d keys, want 19", n)
+	}
+}
+
+type point struct {
+	x, y int
+}
+
+func TestEqVMapStructPointers(t *testing.T) {
+	// The hash only looks at x, so keys sharing it collide and are told apart by
+	// the comparator alone.
+	m := NewEqVMap[int](
+		WithKeyEqual(func(a, b any) bool { return *a.(*point) == *b.(*point) }),
+		WithKeyHash(func(k any) uint64 { return uint64(k.(*point).x) }),
+	)
+
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 4; y++ {
+			v := x*10 + y
+			m.Store(&point{x, y}, &v)
+		}
+	}
+
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 4; y++ {
+			if v, ok := m.Load(&point{x, y}); !ok || *v != x*10+y {
+				t.Fatalf("Load(&point{%d, %d}) = %v, %v", x, y, v, ok)
+			}
+		}
+	}
+
+	v := -1
+	m.Store(&point{1, 2}, &v)
+	if got, _ := m.Load(&point{1, 2}); *got != -1 {
+		t.Fatalf("Store through an equal pointer did not replace the value: %d", *got)
+	}
+	n := 0
+	m.Range(func(any, *int) bool { n++; return true })
+	if n != 16 {
+		t.Fatalf("map holds %d entries, want 16", n)
+	}
+}
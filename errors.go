@@ -0,0 +1,9 @@
+package sync
+
+import "errors"
+
+// ErrMalformedSnapshot is returned, possibly wrapped, when serialized map data
+// cannot be decoded: it is syntactically invalid, or holds keys or values that do
+// not fit the map's types. Callers can test for it with errors.Is to tell bad input,
+// which retrying will not fix, apart from other failures.
+var ErrMalformedSnapshot = errors.New("sync: malformed snapshot")
@@ -4,4 +4,8 @@ import "unsafe"
 
 // expunged is an arbitrary pointer that marks entries which have been deleted
 // from the dirty map.
-var expunged = unsafe.Pointer(new(struct{}))
+//
+// It must point to a non-zero-size allocation: pointers to zero-size values may all
+// be equal, so a sentinel of zero size could be mistaken for a stored *struct{}.
+// Entries compare it as an unsafe.Pointer and never convert it to a typed pointer.
+var expunged = unsafe.Pointer(new(any))
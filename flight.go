@@ -0,0 +1,59 @@
+package sync
+
+import "sync"
+
+// flight is a computation of the value for one key, shared by every caller that
+// asks for the key while it runs.
+type flight[V any] struct {
+	done  chan struct{}
+	value *V
+	err   error
+
+	// ok is false if the leader did not return normally, e.g. because the
+	// computation panicked. Waiters then start over instead of sharing a result.
+	ok bool
+
+	// canceled is set by the leader before finishing if its result is an error
+	// caused by its own context. Such an error says nothing about the key, so the
+	// flight is finished as not ok and waiters whose context is still live start
+	// over.
+	canceled bool
+}
+
+// flightGroup tracks the flights in progress for a map. The zero flightGroup is
+// ready for use.
+type flightGroup[K comparable, V any] struct {
+	mu sync.Mutex
+	m  map[K]*flight[V]
+}
+
+// join returns the flight in progress for key, starting a new one if there is none.
+// leader is true if the caller started the flight and must finish it.
+func (g *flightGroup[K, V]) join(key K) (f *flight[V], leader bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if f, ok := g.m[key]; ok {
+		return f, false
+	}
+
+	if g.m == nil {
+		g.m = make(map[K]*flight[V])
+	}
+
+	f = &flight[V]{done: make(chan struct{})}
+	g.m[key] = f
+
+	return f, true
+}
+
+// finish publishes the result of f and wakes its waiters. A later join for the
+// same key starts a new flight.
+func (g *flightGroup[K, V]) finish(key K, f *flight[V], value *V, err error, ok bool) {
+	g.mu.Lock()
+	delete(g.m, key)
+	g.mu.Unlock()
+
+	f.value, f.err, f.ok = value, err, ok && !f.canceled
+	close(f.done)
+}
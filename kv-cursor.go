@@ -0,0 +1,46 @@
+package sync
+
+// KVCursor iterates over the keys a KVMap held when the cursor was created, one
+// entry per call to Next. It is obtained from KVMap.Cursor.
+//
+// A cursor can be paused and resumed at will, for example across requests of a
+// paginated listing: it holds a snapshot of the keys and its position, not any lock.
+// A KVCursor is not safe for concurrent use, but the map it iterates may be used
+// concurrently while the cursor exists.
+type KVCursor[K comparable, V any] struct {
+	m    *KVMap[K, V]
+	keys []K
+	pos  int
+}
+
+// Cursor returns a cursor over the keys currently present in the map.
+//
+// For KVMap[K,V]: it returns a *KVCursor[K,V].
+//
+// The key set is recorded under the map's lock, as in RangeSnapshot: keys inserted
+// afterwards are never returned by the cursor. Values are loaded again as the
+// cursor reaches each key, and keys deleted in the meantime are skipped.
+func (m *KVMap[K, V]) Cursor() *KVCursor[K, V] {
+	m.mu.Lock()
+	keys := m.keysLocked()
+	m.mu.Unlock()
+
+	return &KVCursor[K, V]{m: m, keys: keys}
+}
+
+// Next returns the next entry that is still present in the map, or the zero key, a
+// nil value and false once the snapshot is exhausted.
+func (c *KVCursor[K, V]) Next() (key K, value *V, ok bool) {
+	for c.pos < len(c.keys) {
+		key = c.keys[c.pos]
+		c.pos++
+
+		if value, ok = c.m.Load(key); ok {
+			return key, value, true
+		}
+	}
+
+	var zero K
+
+	return zero, nil, false
+}
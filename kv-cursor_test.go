@@ -0,0 +1,45 @@
+package sync
+
+import "testing"
+
+func TestCursor(t *testing.T) {
+	var m KVMap[int, int]
+	for i := 0; i < 10; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+
+	c := m.Cursor()
+
+	late := 100
+	m.Store(late, &late)
+	m.Delete(3)
+
+	seen := make(map[int]bool)
+	for {
+		k, v, ok := c.Next()
+		if !ok {
+			break
+		}
+		if seen[k] {
+			t.Fatalf("Next returned key %d twice", k)
+		}
+		if *v != k {
+			t.Fatalf("Next returned %d for key %d", *v, k)
+		}
+		seen[k] = true
+	}
+
+	if len(seen) != 9 || seen[3] || seen[late] {
+		t.Fatalf("cursor visited %v; want 0-9 without the deleted 3 and the late key", seen)
+	}
+	for i := 0; i < 10; i++ {
+		if i != 3 && !seen[i] {
+			t.Errorf("cursor skipped key %d", i)
+		}
+	}
+
+	if _, _, ok := c.Next(); ok {
+		t.Fatal("Next on an exhausted cursor = true")
+	}
+}
@@ -0,0 +1,48 @@
+package sync
+
+// KVMapBuilder collects entries for a new KVMap.
+//
+// It is meant for fixtures and configuration, where a map is filled once with known
+// entries and then shared:
+//
+//	m := NewKVMapBuilder[string, int]().
+//		Set("a", 1).
+//		Set("b", 2).
+//		Build()
+//
+// A KVMapBuilder is not safe for concurrent use.
+type KVMapBuilder[K comparable, V any] struct {
+	entries map[K]V
+}
+
+// NewKVMapBuilder returns an empty KVMapBuilder.
+func NewKVMapBuilder[K comparable, V any]() *KVMapBuilder[K, V] {
+	return &KVMapBuilder[K, V]{entries: make(map[K]V)}
+}
+
+// Set records value under key, replacing any value previously set for that key, and
+// returns the builder so calls can be chained.
+//
+// The value is copied; Build stores a pointer to its own copy.
+func (b *KVMapBuilder[K, V]) Set(key K, value V) *KVMapBuilder[K, V] {
+	b.entries[key] = value
+	return b
+}
+
+// Build returns a new KVMap holding the entries set so far.
+//
+// The entries are placed directly in the map's read-only snapshot, so loads of them
+// never lock. Every call allocates fresh values: maps returned by separate Build
+// calls share nothing, and the builder may keep being used afterwards.
+func (b *KVMapBuilder[K, V]) Build() *KVMap[K, V] {
+	entries := make(map[K]*entry[V], len(b.entries))
+	for k, v := range b.entries {
+		v := v
+		entries[k] = newEntry(&v)
+	}
+
+	m := &KVMap[K, V]{}
+	m.replaceLocked(entries)
+
+	return m
+}
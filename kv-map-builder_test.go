@@ -0,0 +1,32 @@
+package sync
+
+import "testing"
+
+func TestKVMapBuilder(t *testing.T) {
+	b := NewKVMapBuilder[string, int]().
+		Set("a", 1).
+		Set("b", 2).
+		Set("a", 3)
+	m := b.Build()
+
+	if n := m.Len(); n != 2 {
+		t.Fatalf("Len() = %d, want 2", n)
+	}
+	if v, ok := m.Load("a"); !ok || *v != 3 {
+		t.Fatalf("Load(a) = %v, %v; want the last value set, 3", v, ok)
+	}
+	if v, ok := m.Load("b"); !ok || *v != 2 {
+		t.Fatalf("Load(b) = %v, %v; want 2", v, ok)
+	}
+
+	// The builder stays usable, and separate builds share nothing.
+	other := b.Set("c", 4).Build()
+	if _, ok := m.Load("c"); ok {
+		t.Fatal("a later Set leaked into an earlier Build")
+	}
+	va, _ := m.Load("a")
+	vb, _ := other.Load("a")
+	if va == vb {
+		t.Fatal("two builds share a value pointer")
+	}
+}
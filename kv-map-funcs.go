@@ -0,0 +1,583 @@
+package sync
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// DeleteValues deletes every entry whose value is equal to one of vals and returns
+// the number of entries deleted.
+//
+// For KVMap[K,V]: (m *KVMap[K,V], vals ...V) -> (deleted int).
+//
+// Values are compared by content with ==. DeleteValues walks the map with Range and
+// removes each matching entry with CompareAndDelete, so an entry whose value is
+// replaced by another goroutine after it was checked is left alone. The usual Range
+// caveats apply to entries inserted concurrently.
+func DeleteValues[K comparable, V comparable](m *KVMap[K, V], vals ...V) (deleted int) {
+	if len(vals) == 0 {
+		return 0
+	}
+
+	set := make(map[V]struct{}, len(vals))
+	for _, v := range vals {
+		set[v] = struct{}{}
+	}
+
+	m.Range(func(key K, value *V) bool {
+		if _, ok := set[*value]; ok && m.CompareAndDelete(key, value) {
+			deleted++
+		}
+
+		return true
+	})
+
+	return deleted
+}
+
+// Toggle atomically flips the boolean stored for key and returns the new value.
+//
+// For KVMap[K,bool]: an absent key is treated as false, so the first Toggle stores
+// true. Each flip stores a freshly allocated value, installed with CompareAndSwap
+// (or LoadOrStore for an absent key) and retried when another goroutine changed the
+// value first, so concurrent Toggles never cancel out silently: n calls flip the
+// value exactly n times.
+func Toggle[K comparable](m *KVMap[K, bool], key K) bool {
+	for {
+		old, ok := m.Load(key)
+		if !ok {
+			next := true
+			if _, loaded := m.LoadOrStore(key, &next); !loaded {
+				return true
+			}
+
+			continue
+		}
+
+		next := !*old
+		if m.CompareAndSwap(key, old, &next) {
+			return next
+		}
+	}
+}
+
+// StreamJSONArray writes the live entries of m to w as a JSON array, one element
+// per entry, where each element is the JSON encoding of f(key, value).
+//
+// For KVMap[K,V]: f projects (key K, value *V) to any type R that encoding/json can
+// encode.
+//
+// The elements are produced by Range and encoded one by one with a json.Encoder, so
+// no intermediate slice of the whole map is built. The order of the elements is
+// unspecified. The encoder separates elements with newlines, which is valid JSON
+// whitespace. If encoding or writing fails, StreamJSONArray stops and returns the
+// error; w may then hold a truncated array.
+func StreamJSONArray[K comparable, V, R any](m *KVMap[K, V], w io.Writer, f func(key K, value *V) R) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	first := true
+
+	var err error
+	m.Range(func(key K, value *V) bool {
+		if !first {
+			if _, err = io.WriteString(w, ","); err != nil {
+				return false
+			}
+		}
+		first = false
+
+		err = enc.Encode(f(key, value))
+
+		return err == nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "]")
+
+	return err
+}
+
+// FromSlices returns a new KVMap that maps keys[i] to values[i] for every index i.
+//
+// keys and values must have the same length; otherwise FromSlices returns a nil map
+// and an error. If a key appears more than once, the value at its last index wins.
+// Each value is copied into its own allocation, so the map does not alias values.
+// As with KVMapBuilder, the entries start out in the read-only snapshot and can be
+// loaded without locking.
+func FromSlices[K comparable, V any](keys []K, values []V) (*KVMap[K, V], error) {
+	if len(keys) != len(values) {
+		return nil, fmt.Errorf("sync: FromSlices: %d keys but %d values", len(keys), len(values))
+	}
+
+	entries := make(map[K]*entry[V], len(keys))
+	for i, k := range keys {
+		v := values[i]
+		entries[k] = newEntry(&v)
+	}
+
+	m := &KVMap[K, V]{}
+	m.replaceLocked(entries)
+
+	return m, nil
+}
+
+// GetAndIncrement atomically adds one to the counter stored for key and returns the
+// value it had before the increment.
+//
+// For KVMap[K,int64]: an absent key counts as 0, so the first caller gets 0 and leaves
+// 1 in the map. Every call installs a new value with CompareAndSwap (or LoadOrStore
+// for an absent key) and retries on contention, so concurrent callers always get
+// distinct results, which makes GetAndIncrement suitable for handing out sequence
+// numbers.
+func GetAndIncrement[K comparable](m *KVMap[K, int64], key K) int64 {
+	for {
+		old, ok := m.Load(key)
+		if !ok {
+			next := int64(1)
+			if _, loaded := m.LoadOrStore(key, &next); !loaded {
+				return 0
+			}
+
+			continue
+		}
+
+		next := *old + 1
+		if m.CompareAndSwap(key, old, &next) {
+			return *old
+		}
+	}
+}
+
+// DecAndDeleteAtZero atomically subtracts one from the counter stored for key, and
+// deletes the entry instead if the result would be zero or less.
+//
+// For KVMap[K,int64]: remaining is the counter after the decrement, and deleted
+// reports whether the entry was removed. An absent key is left absent and yields
+// (0, false). The last decrement removes the entry with a single CompareAndDelete,
+// so no goroutine ever observes a zero counter: an increment racing with it either
+// lands first, in which case the entry survives with the incremented count, or
+// finds the key absent and starts a new entry. It pairs with GetAndIncrement or Add
+// for reference counting.
+func DecAndDeleteAtZero[K comparable](m *KVMap[K, int64], key K) (remaining int64, deleted bool) {
+	for {
+		old, ok := m.Load(key)
+		if !ok {
+			return 0, false
+		}
+
+		next := *old - 1
+		if next <= 0 {
+			if m.CompareAndDelete(key, old) {
+				return next, true
+			}
+
+			continue
+		}
+
+		if m.CompareAndSwap(key, old, &next) {
+			return next, false
+		}
+	}
+}
+
+// ContainsValue reports whether any live entry of m holds a value equal to want.
+//
+// Values are compared by content with ==. ContainsValue ranges over the map and
+// stops at the first match, so it is O(n) in the worst case.
+func ContainsValue[K comparable, V comparable](m *KVMap[K, V], want V) (found bool) {
+	m.Range(func(_ K, v *V) bool {
+		found = *v == want
+		return !found
+	})
+
+	return found
+}
+
+// ValuesEqual loads the values stored for a and b and reports whether they are equal
+// by content, and whether both keys were present.
+//
+// If either key is absent, it returns (false, false). The two keys are loaded one
+// after the other, not as a snapshot, so with concurrent writers the answer reflects
+// each key at a slightly different moment.
+func ValuesEqual[K comparable, V comparable](m *KVMap[K, V], a, b K) (equal bool, bothPresent bool) {
+	va, ok := m.Load(a)
+	if !ok {
+		return false, false
+	}
+
+	vb, ok := m.Load(b)
+	if !ok {
+		return false, false
+	}
+
+	return *va == *vb, true
+}
+
+// KeyOf returns a key whose value is equal to want, and whether one was found.
+//
+// Values are compared by content with ==. Several keys may hold the same value; KeyOf
+// returns whichever one Range reaches first, which is unspecified. If no entry
+// matches, it returns the zero key and false.
+func KeyOf[K comparable, V comparable](m *KVMap[K, V], want V) (key K, found bool) {
+	m.Range(func(k K, v *V) bool {
+		if *v == want {
+			key, found = k, true
+			return false
+		}
+
+		return true
+	})
+
+	return key, found
+}
+
+// Invert returns a new KVMap mapping each value of m to its key.
+//
+// Values become keys by content: the result's values are freshly allocated copies of
+// the keys of m, stored in the result's read-only snapshot. When several keys of m
+// hold equal values, only one of them survives in the result, and which one is
+// unspecified. For maps whose values are unique, inverting twice yields a map equal
+// to m.
+func Invert[K comparable, V comparable](m *KVMap[K, V]) *KVMap[V, K] {
+	entries := make(map[V]*entry[K], len(m.loadReadOnly().m))
+	m.Range(func(k K, v *V) bool {
+		entries[*v] = newEntry(&k)
+		return true
+	})
+
+	inv := &KVMap[V, K]{}
+	inv.replaceLocked(entries)
+
+	return inv
+}
+
+// ValuesSortedByKey returns the values of the live entries of m, ordered by
+// ascending key.
+//
+// For KVMap[K,V] with an ordered K: the result holds the stored pointers, not
+// copies. The entries are collected with Range before sorting, so its consistency
+// notes apply.
+func ValuesSortedByKey[K cmp.Ordered, V any](m *KVMap[K, V]) []*V {
+	entries := sortedPairs(m, nil)
+
+	values := make([]*V, len(entries))
+	for i, e := range entries {
+		values[i] = e.Value
+	}
+
+	return values
+}
+
+// Tally returns a new KVMap counting how many times each distinct item occurs in
+// items.
+//
+// For KVMap[K,int64]: the counts are computed up front without any locking and
+// installed as the read-only snapshot of the result, so lookups of the tallied keys
+// are lock-free from the start. The result is an ordinary KVMap and can be updated
+// concurrently afterwards, for example with GetAndIncrement.
+func Tally[K comparable](items []K) *KVMap[K, int64] {
+	counts := make(map[K]int64)
+	for _, item := range items {
+		counts[item]++
+	}
+
+	entries := make(map[K]*entry[int64], len(counts))
+	for k, n := range counts {
+		n := n
+		entries[k] = newEntry(&n)
+	}
+
+	m := &KVMap[K, int64]{}
+	m.replaceLocked(entries)
+
+	return m
+}
+
+// MaxValue returns a live entry of m holding the largest value, and whether the map
+// had any entry at all.
+//
+// For KVMap[K,V] with an ordered V: MaxValue ranges over the map once. When several
+// keys hold the largest value, which of them is returned is unspecified. For
+// floating-point values, NaN compares as less than every other value, as in
+// cmp.Compare. An empty map yields the zero key and value and false.
+func MaxValue[K comparable, V cmp.Ordered](m *KVMap[K, V]) (key K, value V, ok bool) {
+	return extremeValue(m, 1)
+}
+
+// MinValue is like MaxValue, but returns an entry holding the smallest value.
+func MinValue[K comparable, V cmp.Ordered](m *KVMap[K, V]) (key K, value V, ok bool) {
+	return extremeValue(m, -1)
+}
+
+// extremeValue returns the entry of m whose value compares in the direction of sign
+// (1 for the largest, -1 for the smallest) against every other one.
+func extremeValue[K comparable, V cmp.Ordered](m *KVMap[K, V], sign int) (key K, value V, ok bool) {
+	m.Range(func(k K, v *V) bool {
+		if !ok || cmp.Compare(*v, value)*sign > 0 {
+			key, value, ok = k, *v, true
+		}
+
+		return true
+	})
+
+	return key, value, ok
+}
+
+// CompareFieldAndSwap stores new for key if field, applied to the current value,
+// returns expected, and reports whether it did.
+//
+// For KVMap[K,V]: field extracts a comparable F from a value, typically a version or
+// revision number embedded in V. It generalizes VersionedKVMap's version check to
+// any field the caller maintains. An absent key never matches. A match is installed
+// with CompareAndSwap against the value that was checked, and if another goroutine
+// replaced it in the meantime, the check is repeated on the new value, so field may
+// be called several times and must not have side effects. A nil new deletes the
+// entry on a match.
+func CompareFieldAndSwap[K comparable, V any, F comparable](m *KVMap[K, V], key K, field func(*V) F, expected F, new *V) (swapped bool) {
+	for {
+		cur, ok := m.Load(key)
+		if !ok || field(cur) != expected {
+			return false
+		}
+
+		if m.CompareAndSwap(key, cur, new) {
+			return true
+		}
+	}
+}
+
+// CountBy ranges over m once and returns how many live entries fall into each group,
+// as assigned by classify. Groups with no entries are absent from the result. The
+// counts follow the consistency notes of Range.
+func CountBy[K comparable, V any, G comparable](m *KVMap[K, V], classify func(key K, value *V) G) map[G]int {
+	counts := make(map[G]int)
+	m.Range(func(k K, v *V) bool {
+		counts[classify(k, v)]++
+		return true
+	})
+
+	return counts
+}
+
+// FindN returns up to n live entries of m for which pred returns true, and stops
+// ranging as soon as it has n of them.
+//
+// For KVMap[K,V]: the result maps the matching keys to the stored pointers. Which
+// entries are found first when more than n match is unspecified, as is the order of
+// Range. A non-positive n returns an empty map without ranging.
+func FindN[K comparable, V any](m *KVMap[K, V], n int, pred func(key K, value *V) bool) map[K]*V {
+	found := make(map[K]*V)
+	if n <= 0 {
+		return found
+	}
+
+	m.Range(func(k K, v *V) bool {
+		if pred(k, v) {
+			found[k] = v
+		}
+
+		return len(found) < n
+	})
+
+	return found
+}
+
+// Add atomically adds delta to the value stored for key and returns the new value.
+//
+// For KVMap[K,V] with a Number V: it is the KVMap counterpart of AddV. An absent key
+// counts as zero, and each addition stores a freshly allocated value with
+// CompareAndSwap (or LoadOrStore for an absent key), retrying if another goroutine
+// got there first, so no concurrent addition is lost.
+func Add[K comparable, V Number](m *KVMap[K, V], key K, delta V) V {
+	for {
+		old, ok := m.Load(key)
+		if !ok {
+			next := delta
+			if _, loaded := m.LoadOrStore(key, &next); !loaded {
+				return next
+			}
+
+			continue
+		}
+
+		next := *old + delta
+		if m.CompareAndSwap(key, old, &next) {
+			return next
+		}
+	}
+}
+
+// AddMany applies Add to every key of deltas.
+//
+// Keys already in the read-only snapshot are updated in place without locking, as
+// Add does. The others, which need the lock to be inserted, are collected and all
+// added under a single acquisition of it, so a batch of mostly new keys costs one
+// lock round trip instead of one per key. The batch is not atomic as a whole:
+// concurrent readers may see some deltas applied and others not yet, and the keys
+// updated outside the lock are not ordered against the others. Zero deltas are
+// skipped, so they do not create entries for absent keys.
+func AddMany[K comparable, V Number](m *KVMap[K, V], deltas map[K]V) {
+	var missed []K
+
+	read := m.beginWrite()
+	for k, d := range deltas {
+		if d != 0 && !addEntry(m, read, k, d) {
+			if missed == nil {
+				missed = make([]K, 0, len(deltas))
+			}
+
+			missed = append(missed, k)
+		}
+	}
+	m.endWrite()
+
+	if len(missed) == 0 {
+		return
+	}
+
+	m.lockWrite()
+	defer m.mu.Unlock()
+
+	for _, k := range missed {
+		addLocked(m, k, deltas[k])
+	}
+}
+
+// addEntry adds delta to the value of key if read holds a live entry for it that
+// may be updated without the lock, and reports whether it did.
+func addEntry[K comparable, V Number](m *KVMap[K, V], read kvreadOnly[K, V], key K, delta V) bool {
+	e, ok := read.writable(key)
+	if !ok {
+		return false
+	}
+
+	for {
+		old, ok := e.load()
+		if !ok {
+			return false
+		}
+
+		next := *old + delta
+		if m.compareAndSwapEntry(e, old, &next) {
+			return true
+		}
+	}
+}
+
+// addLocked is the locked equivalent of Add. m.mu must be held.
+func addLocked[K comparable, V Number](m *KVMap[K, V], key K, delta V) {
+	for {
+		if e, ok := m.entryLocked(key); ok {
+			if old, ok := e.load(); ok {
+				next := *old + delta
+				if m.compareAndSwapEntry(e, old, &next) {
+					return
+				}
+
+				continue
+			}
+		}
+
+		next := delta
+		if _, loaded := m.loadOrStoreLocked(key, &next); !loaded {
+			return
+		}
+	}
+}
+
+// BindString calls the setter of every key of binders that is present in m with the
+// key's value, and returns the first error a setter reports.
+//
+// For KVMap[string,string]: it is a small, reflection-free way to populate a config
+// struct, with one setter per field parsing the string into it. Absent keys are
+// skipped, leaving their fields at whatever default the caller set. Binders run in
+// ascending key order, so the error returned for a given input is deterministic;
+// binding stops at the first failing setter, and the error is wrapped with the key
+// it came from.
+func BindString(m *KVMap[string, string], binders map[string]func(string) error) error {
+	keys := make([]string, 0, len(binders))
+	for k := range binders {
+		keys = append(keys, k)
+	}
+
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		v, ok := m.Load(k)
+		if !ok {
+			continue
+		}
+
+		if err := binders[k](*v); err != nil {
+			return fmt.Errorf("sync: BindString: %s: %w", k, err)
+		}
+	}
+
+	return nil
+}
+
+// SortedPairs returns the live entries of m as a slice of pairs sorted by ascending
+// key.
+//
+// For KVMap[K,V] with an ordered K: the pairs hold the stored pointers, not copies,
+// and the slice is new on every call. The entries are collected with Range before
+// sorting, so its consistency notes apply.
+func SortedPairs[K cmp.Ordered, V any](m *KVMap[K, V]) []KV[K, *V] {
+	return sortedPairs(m, nil)
+}
+
+// RangeBetween calls f sequentially, in ascending key order, for each live entry of m
+// whose key lies between lo and hi inclusive. If f returns false, the iteration
+// stops.
+//
+// For KVMap[K,V] with an ordered K: the entries in the window are collected with
+// Range and sorted before f is first called, so f may modify the map, changes made
+// during the pass are not visited, and the cost is a full pass over the map plus a
+// sort of the window. If lo is greater than hi, nothing is visited.
+func RangeBetween[K cmp.Ordered, V any](m *KVMap[K, V], lo, hi K, f func(key K, value *V) bool) {
+	if cmp.Less(hi, lo) {
+		return
+	}
+
+	entries := sortedPairs(m, func(k K) bool {
+		return !cmp.Less(k, lo) && !cmp.Less(hi, k)
+	})
+
+	for _, e := range entries {
+		if !f(e.Key, e.Value) {
+			return
+		}
+	}
+}
+
+// sortedPairs collects the live entries of m whose key satisfies keep, or all of
+// them if keep is nil, sorted by ascending key.
+func sortedPairs[K cmp.Ordered, V any](m *KVMap[K, V], keep func(K) bool) []KV[K, *V] {
+	var entries []KV[K, *V]
+	if keep == nil {
+		entries = make([]KV[K, *V], 0, len(m.loadReadOnly().m))
+	}
+
+	m.Range(func(k K, v *V) bool {
+		if keep == nil || keep(k) {
+			entries = append(entries, KV[K, *V]{Key: k, Value: v})
+		}
+
+		return true
+	})
+
+	slices.SortFunc(entries, func(a, b KV[K, *V]) int {
+		return cmp.Compare(a.Key, b.Key)
+	})
+
+	return entries
+}
@@ -0,0 +1,671 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newKVMap returns a KVMap holding a copy of entries.
+func newKVMap[K comparable, V any](entries map[K]V) *KVMap[K, V] {
+	m := new(KVMap[K, V])
+	for k, v := range entries {
+		v := v
+		m.Store(k, &v)
+	}
+
+	return m
+}
+
+func TestDeleteValues(t *testing.T) {
+	m := newKVMap(map[string]int{"a": 0, "b": 1, "c": 2, "d": 1, "e": 3, "f": 0})
+
+	if n := DeleteValues(m, 0, 1); n != 4 {
+		t.Fatalf("DeleteValues(0, 1) = %d, want 4", n)
+	}
+
+	got := m.snapshot()
+	if len(got) != 2 || *got["c"] != 2 || *got["e"] != 3 {
+		t.Fatalf("survivors = %v, want c: 2 and e: 3", got)
+	}
+
+	if n := DeleteValues(m); n != 0 {
+		t.Fatalf("DeleteValues() with no values = %d, want 0", n)
+	}
+}
+
+func TestToggleConcurrent(t *testing.T) {
+	var m KVMap[string, bool]
+	if !Toggle(&m, "k") {
+		t.Fatal("first Toggle of an absent key = false, want true")
+	}
+
+	const goroutines, flips = 8, 250
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < flips; j++ {
+				Toggle(&m, "k")
+			}
+		}()
+	}
+	wg.Wait()
+
+	// An even number of flips brings the key back to where it started.
+	if v, ok := m.Load("k"); !ok || !*v {
+		t.Fatalf("Load(k) = %v, %v after %d flips, want true", v, ok, goroutines*flips)
+	}
+}
+
+func TestStreamJSONArray(t *testing.T) {
+	type row struct {
+		Name  string `json:"name"`
+		Twice int    `json:"twice"`
+	}
+
+	m := newKVMap(map[string]int{"a": 1, "b": 2, "c": 3})
+
+	var buf bytes.Buffer
+	if err := StreamJSONArray(m, &buf, func(k string, v *int) row {
+		return row{Name: k, Twice: *v * 2}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []row
+	if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+		t.Fatalf("output %q does not parse: %v", buf.String(), err)
+	}
+
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Name < rows[j].Name })
+	want := []row{{"a", 2}, {"b", 4}, {"c", 6}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Fatalf("rows = %v, want %v", rows, want)
+	}
+
+	var empty bytes.Buffer
+	if err := StreamJSONArray(new(KVMap[string, int]), &empty, func(k string, _ *int) string { return k }); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(empty.Bytes(), &rows); err != nil || len(rows) != 0 {
+		t.Fatalf("empty map streamed %q", empty.String())
+	}
+}
+
+func TestFromSlices(t *testing.T) {
+	m, err := FromSlices([]string{"a", "b", "a"}, []int{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := m.snapshot()
+	if len(got) != 2 || *got["a"] != 3 || *got["b"] != 2 {
+		t.Fatalf("FromSlices = %v, want a: 3 (last index wins), b: 2", got)
+	}
+	if !m.ContainsFast("a") {
+		t.Fatal("FromSlices entries are not in the read-only snapshot")
+	}
+
+	m, err = FromSlices([]string{"a", "b"}, []int{1})
+	if err == nil || m != nil {
+		t.Fatalf("FromSlices with mismatched lengths = %v, %v; want nil, an error", m, err)
+	}
+}
+
+func TestGetAndIncrementUniqueIDs(t *testing.T) {
+	var m KVMap[string, int64]
+
+	const goroutines, perGoroutine = 8, 500
+	ids := make(chan int64, goroutines*perGoroutine)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perGoroutine; j++ {
+				ids <- GetAndIncrement(&m, "seq")
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[int64]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("id %d handed out twice", id)
+		}
+		seen[id] = true
+	}
+	for id := int64(0); id < goroutines*perGoroutine; id++ {
+		if !seen[id] {
+			t.Fatalf("id %d never handed out", id)
+		}
+	}
+	if v, _ := m.Load("seq"); *v != goroutines*perGoroutine {
+		t.Fatalf("counter = %d, want %d", *v, goroutines*perGoroutine)
+	}
+}
+
+func TestContainsValue(t *testing.T) {
+	m := newKVMap(map[string]int{"a": 1, "b": 2})
+
+	if !ContainsValue(m, 2) {
+		t.Fatal("ContainsValue(2) = false for a present value")
+	}
+	if ContainsValue(m, 3) {
+		t.Fatal("ContainsValue(3) = true for an absent value")
+	}
+
+	m.Delete("b")
+	if ContainsValue(m, 2) {
+		t.Fatal("ContainsValue(2) = true after its key was deleted")
+	}
+}
+
+func TestKeyOf(t *testing.T) {
+	m := newKVMap(map[string]int{"a": 1, "b": 2, "c": 2})
+
+	if k, ok := KeyOf(m, 1); !ok || k != "a" {
+		t.Fatalf("KeyOf(1) = %q, %v; want a, true", k, ok)
+	}
+	if k, ok := KeyOf(m, 2); !ok || (k != "b" && k != "c") {
+		t.Fatalf("KeyOf(2) = %q, %v; want b or c", k, ok)
+	}
+	if k, ok := KeyOf(m, 3); ok || k != "" {
+		t.Fatalf("KeyOf(3) = %q, %v; want the zero key, false", k, ok)
+	}
+}
+
+func TestInvert(t *testing.T) {
+	m := newKVMap(map[string]int{"one": 1, "two": 2, "three": 3})
+
+	inv := Invert(m)
+	if k, ok := inv.Load(2); !ok || *k != "two" {
+		t.Fatalf("Invert: Load(2) = %v, %v; want two", k, ok)
+	}
+	if n := inv.Len(); n != 3 {
+		t.Fatalf("Invert: Len() = %d, want 3", n)
+	}
+
+	back := Invert(inv).snapshot()
+	if len(back) != 3 {
+		t.Fatalf("inverting twice gave %d keys, want 3", len(back))
+	}
+	for k, v := range m.snapshot() {
+		if b, ok := back[k]; !ok || *b != *v {
+			t.Errorf("inverting twice: %s = %v, want %d", k, b, *v)
+		}
+	}
+}
+
+func TestValuesSortedByKey(t *testing.T) {
+	m := newKVMap(map[string]string{"c": "third", "a": "first", "b": "second"})
+
+	var got []string
+	for _, v := range ValuesSortedByKey(m) {
+		got = append(got, *v)
+	}
+	if want := []string{"first", "second", "third"}; !slices.Equal(got, want) {
+		t.Fatalf("ValuesSortedByKey = %v, want %v", got, want)
+	}
+
+	if vs := ValuesSortedByKey(new(KVMap[int, int])); len(vs) != 0 {
+		t.Fatalf("ValuesSortedByKey of an empty map = %v", vs)
+	}
+}
+
+func TestTally(t *testing.T) {
+	m := Tally([]string{"a", "b", "a", "c", "a", "b"})
+
+	want := map[string]int64{"a": 3, "b": 2, "c": 1}
+	got := m.snapshot()
+	if len(got) != len(want) {
+		t.Fatalf("Tally has %d keys, want %d", len(got), len(want))
+	}
+	for k, n := range want {
+		if *got[k] != n {
+			t.Errorf("Tally[%q] = %d, want %d", k, *got[k], n)
+		}
+	}
+
+	if n := Tally[int](nil).Len(); n != 0 {
+		t.Fatalf("Tally(nil) has %d keys", n)
+	}
+}
+
+func TestMinMaxValue(t *testing.T) {
+	m := newKVMap(map[string]int{"a": 5, "b": -2, "c": 9, "d": 0})
+
+	if k, v, ok := MaxValue(m); !ok || k != "c" || v != 9 {
+		t.Fatalf("MaxValue = %q, %d, %v; want c, 9", k, v, ok)
+	}
+	if k, v, ok := MinValue(m); !ok || k != "b" || v != -2 {
+		t.Fatalf("MinValue = %q, %d, %v; want b, -2", k, v, ok)
+	}
+
+	var empty KVMap[string, int]
+	if k, v, ok := MaxValue(&empty); ok || k != "" || v != 0 {
+		t.Fatalf("MaxValue of an empty map = %q, %d, %v", k, v, ok)
+	}
+	if _, _, ok := MinValue(&empty); ok {
+		t.Fatal("MinValue of an empty map reported a value")
+	}
+}
+
+type document struct {
+	version int
+	data    string
+}
+
+func TestCompareFieldAndSwap(t *testing.T) {
+	var m KVMap[string, document]
+	m.Store("k", &document{version: 1, data: "a"})
+	version := func(v *document) int { return v.version }
+
+	if CompareFieldAndSwap(&m, "k", version, 2, &document{version: 3, data: "b"}) {
+		t.Fatal("CompareFieldAndSwap swapped on a stale version")
+	}
+	if !CompareFieldAndSwap(&m, "k", version, 1, &document{version: 2, data: "b"}) {
+		t.Fatal("CompareFieldAndSwap did not swap on the current version")
+	}
+	if v, _ := m.Load("k"); v.version != 2 || v.data != "b" {
+		t.Fatalf("Load(k) = %+v after the swap", *v)
+	}
+	if CompareFieldAndSwap(&m, "missing", version, 0, &document{}) {
+		t.Fatal("CompareFieldAndSwap matched an absent key")
+	}
+	if !CompareFieldAndSwap(&m, "k", version, 2, nil) {
+		t.Fatal("CompareFieldAndSwap with a nil value did not match")
+	}
+	if _, ok := m.Load("k"); ok {
+		t.Fatal("CompareFieldAndSwap with a nil value left the key")
+	}
+}
+
+func TestCountBy(t *testing.T) {
+	entries := make(map[int]int)
+	for i := 0; i < 25; i++ {
+		entries[i] = i
+	}
+	m := newKVMap(entries)
+
+	got := CountBy(m, func(_ int, v *int) bool { return *v%2 == 0 })
+	if want := map[bool]int{true: 13, false: 12}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("CountBy = %v, want %v", got, want)
+	}
+
+	if got := CountBy(new(KVMap[int, int]), func(int, *int) bool { return true }); len(got) != 0 {
+		t.Fatalf("CountBy on an empty map = %v", got)
+	}
+}
+
+func TestFindN(t *testing.T) {
+	entries := make(map[int]int)
+	for i := 0; i < 100; i++ {
+		entries[i] = i
+	}
+	m := newKVMap(entries)
+	even := func(_ int, v *int) bool { return *v%2 == 0 }
+
+	calls := 0
+	got := FindN(m, 5, func(k int, v *int) bool { calls++; return even(k, v) })
+	if len(got) != 5 {
+		t.Fatalf("FindN(5) returned %d entries", len(got))
+	}
+	for k, v := range got {
+		if k%2 != 0 || *v != k {
+			t.Fatalf("FindN returned %d = %d", k, *v)
+		}
+	}
+	if calls == 100 {
+		t.Fatal("FindN ranged over the whole map instead of stopping at n matches")
+	}
+
+	if got := FindN(m, 1000, even); len(got) != 50 {
+		t.Fatalf("FindN(1000) returned %d entries, want all 50 matches", len(got))
+	}
+	if got := FindN(m, 0, even); len(got) != 0 {
+		t.Fatalf("FindN(0) returned %d entries", len(got))
+	}
+}
+
+func TestAddMany(t *testing.T) {
+	m := newKVMap(map[string]int{"a": 1, "b": 2})
+	AddMany(m, map[string]int{"a": 10, "c": 3, "d": 0})
+
+	if got, want := snapshotKVMap(m), map[string]int{"a": 11, "b": 2, "c": 3}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after AddMany = %v, want %v", got, want)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				AddMany(m, map[string]int{"a": 1, "b": 2})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, want := snapshotKVMap(m), map[string]int{"a": 411, "b": 802, "c": 3}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after concurrent AddMany = %v, want %v", got, want)
+	}
+}
+
+// TestAddManyConcurrentInserts runs batches of mostly absent keys concurrently with
+// Add on the same keys, so that AddMany's locked path races with the lock-free one,
+// and checks that no delta is lost.
+func TestAddManyConcurrentInserts(t *testing.T) {
+	const keys = 32
+
+	deltas := make(map[int]int, keys)
+	for k := 0; k < keys; k++ {
+		deltas[k] = 1
+	}
+
+	for _, m := range []*KVMap[int, int]{new(KVMap[int, int]), NewSmallKVMap[int, int]()} {
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			g := g
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					if g%2 == 0 {
+						AddMany(m, deltas)
+					} else {
+						for k := range deltas {
+							Add(m, k, 1)
+						}
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		for k := 0; k < keys; k++ {
+			if v, ok := m.Load(k); !ok || *v != 400 {
+				t.Errorf("key %d = %v, %v; want 400", k, v, ok)
+			}
+		}
+	}
+}
+
+// snapshotKVMap copies the live entries of m into a plain map.
+func snapshotKVMap[K comparable, V any](m *KVMap[K, V]) map[K]V {
+	out := make(map[K]V)
+	m.Range(func(k K, v *V) bool {
+		out[k] = *v
+		return true
+	})
+
+	return out
+}
+
+// BenchmarkAddMany compares AddMany with a loop of Add over a batch of 64 keys, once
+// with every key already present and once with only one in eight present, so that
+// most keys have to be inserted under the lock.
+func BenchmarkAddMany(b *testing.B) {
+	deltas := make(map[int]int)
+	for i := 0; i < 64; i++ {
+		deltas[i] = 1
+	}
+
+	addLoop := func(m *KVMap[int, int], deltas map[int]int) {
+		for k, d := range deltas {
+			Add(m, k, d)
+		}
+	}
+
+	for _, impl := range []struct {
+		name string
+		add  func(m *KVMap[int, int], deltas map[int]int)
+	}{
+		{"AddMany", AddMany[int, int]},
+		{"AddLoop", addLoop},
+	} {
+		impl := impl
+		b.Run("Present/"+impl.name, func(b *testing.B) {
+			m := new(KVMap[int, int])
+			impl.add(m, deltas)
+			m.Promote()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				impl.add(m, deltas)
+			}
+		})
+		b.Run("Missing/"+impl.name, func(b *testing.B) {
+			// The maps are built in batches with the timer stopped, so that neither
+			// their construction nor a heap of b.N of them is measured.
+			maps := make([]*KVMap[int, int], 256)
+			fill := func() {
+				for i := range maps {
+					maps[i] = new(KVMap[int, int])
+					for k := 0; k < len(deltas); k += 8 {
+						Add(maps[i], k, 1)
+					}
+					maps[i].Promote()
+				}
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m := maps[i%len(maps)]
+				if i%len(maps) == 0 {
+					b.StopTimer()
+					fill()
+					m = maps[0]
+					b.StartTimer()
+				}
+
+				impl.add(m, deltas)
+			}
+		})
+	}
+}
+
+func TestBindString(t *testing.T) {
+	var cfg struct {
+		port    int
+		debug   bool
+		timeout int
+	}
+	cfg.timeout = 30
+
+	binders := map[string]func(string) error{
+		"port": func(s string) (err error) {
+			cfg.port, err = strconv.Atoi(s)
+			return err
+		},
+		"debug": func(s string) (err error) {
+			cfg.debug, err = strconv.ParseBool(s)
+			return err
+		},
+		"timeout": func(s string) (err error) {
+			cfg.timeout, err = strconv.Atoi(s)
+			return err
+		},
+	}
+
+	m := newKVMap(map[string]string{"port": "8080", "debug": "true", "unused": "x"})
+	if err := BindString(m, binders); err != nil {
+		t.Fatalf("BindString() error = %v", err)
+	}
+	if cfg.port != 8080 || !cfg.debug || cfg.timeout != 30 {
+		t.Fatalf("BindString bound %+v", cfg)
+	}
+
+	m = newKVMap(map[string]string{"port": "http", "debug": "maybe"})
+	err := BindString(m, binders)
+	if !errors.Is(err, strconv.ErrSyntax) {
+		t.Fatalf("BindString() error = %v, want a syntax error", err)
+	}
+	// Binders run in key order, so debug fails first.
+	if !strings.Contains(err.Error(), "debug") {
+		t.Fatalf("BindString() error = %v, want it to name debug", err)
+	}
+}
+
+func TestRangeBetween(t *testing.T) {
+	entries := make(map[int]int)
+	for i := 0; i < 100; i += 5 {
+		entries[i] = i
+	}
+	m := newKVMap(entries)
+
+	var got []int
+	RangeBetween(m, 12, 40, func(k int, v *int) bool {
+		if *v != k {
+			t.Errorf("RangeBetween: %d = %d", k, *v)
+		}
+		got = append(got, k)
+		return true
+	})
+	if want := []int{15, 20, 25, 30, 35, 40}; !slices.Equal(got, want) {
+		t.Fatalf("RangeBetween(12, 40) visited %v, want %v", got, want)
+	}
+
+	got = nil
+	RangeBetween(m, 0, 100, func(k int, _ *int) bool {
+		got = append(got, k)
+		return len(got) < 3
+	})
+	if want := []int{0, 5, 10}; !slices.Equal(got, want) {
+		t.Fatalf("RangeBetween stopped after %v, want %v", got, want)
+	}
+
+	RangeBetween(m, 40, 12, func(k int, _ *int) bool {
+		t.Errorf("RangeBetween with lo > hi visited %d", k)
+		return true
+	})
+}
+
+func TestSortedPairs(t *testing.T) {
+	entries := make(map[string]int)
+	for i := 0; i < 50; i++ {
+		entries[strconv.Itoa(i)] = i
+	}
+	m := newKVMap(entries)
+
+	pairs := SortedPairs(m)
+	if len(pairs) != len(entries) {
+		t.Fatalf("SortedPairs returned %d pairs, want %d", len(pairs), len(entries))
+	}
+	for i, p := range pairs {
+		if i > 0 && pairs[i-1].Key >= p.Key {
+			t.Fatalf("pairs %d and %d out of order: %q, %q", i-1, i, pairs[i-1].Key, p.Key)
+		}
+		if stored, _ := m.Load(p.Key); p.Value != stored {
+			t.Fatalf("pair %q does not hold the stored pointer", p.Key)
+		}
+	}
+
+	if pairs := SortedPairs(new(KVMap[int, int])); len(pairs) != 0 {
+		t.Fatalf("SortedPairs on an empty map = %v", pairs)
+	}
+}
+
+func TestDecAndDeleteAtZero(t *testing.T) {
+	var m KVMap[string, int64]
+	if remaining, deleted := DecAndDeleteAtZero(&m, "absent"); remaining != 0 || deleted {
+		t.Fatalf("DecAndDeleteAtZero on an absent key = %d, %v", remaining, deleted)
+	}
+
+	Add(&m, "k", 2)
+	if remaining, deleted := DecAndDeleteAtZero(&m, "k"); remaining != 1 || deleted {
+		t.Fatalf("first DecAndDeleteAtZero = %d, %v; want 1, false", remaining, deleted)
+	}
+	if remaining, deleted := DecAndDeleteAtZero(&m, "k"); remaining != 0 || !deleted {
+		t.Fatalf("second DecAndDeleteAtZero = %d, %v; want 0, true", remaining, deleted)
+	}
+	if m.Contains("k") {
+		t.Fatal("counter at zero left in the map")
+	}
+}
+
+func TestDecAndDeleteAtZeroConcurrent(t *testing.T) {
+	var (
+		m    KVMap[string, int64]
+		wg   sync.WaitGroup
+		stop = make(chan struct{})
+	)
+
+	// A reader checks that no goroutine ever observes a counter at zero.
+	reader := make(chan struct{})
+	go func() {
+		defer close(reader)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if v, ok := m.Load("k"); ok && *v <= 0 {
+				t.Errorf("observed counter %d", *v)
+				return
+			}
+			runtime.Gosched()
+		}
+	}()
+
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				Add(&m, "k", 1)
+				if i%2 == 0 {
+					runtime.Gosched()
+				}
+				DecAndDeleteAtZero(&m, "k")
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-reader
+
+	if v, ok := m.Load("k"); ok {
+		t.Fatalf("counter left at %d after balanced increments and decrements", *v)
+	}
+}
+
+func TestValuesEqual(t *testing.T) {
+	m := newKVMap(map[string]int{"a": 1, "b": 1, "c": 2})
+
+	for _, tc := range []struct {
+		name               string
+		a, b               string
+		equal, bothPresent bool
+	}{
+		{"Equal", "a", "b", true, true},
+		{"Unequal", "a", "c", false, true},
+		{"Same", "c", "c", true, true},
+		{"FirstMissing", "x", "a", false, false},
+		{"SecondMissing", "a", "x", false, false},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			equal, both := ValuesEqual(m, tc.a, tc.b)
+			if equal != tc.equal || both != tc.bothPresent {
+				t.Fatalf("ValuesEqual(%q, %q) = %v, %v; want %v, %v", tc.a, tc.b, equal, both, tc.equal, tc.bothPresent)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MarshalJSON implements json.Marshaler. The map is encoded as a JSON object, with
+// one member per live entry.
+//
+// Encoding is delegated to encoding/json, applied to a plain map[K]*V built from a
+// Range over the map. Keys are therefore subject to the usual encoding/json rules
+// for map keys (strings, integers, or types implementing encoding.TextMarshaler),
+// members are sorted by key, and values are encoded exactly as encoding/json would
+// encode a *V, honoring json.Marshaler, encoding.TextMarshaler and struct tags.
+//
+// If the map is modified concurrently, the output reflects the state seen by Range.
+func (m *KVMap[K, V]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.snapshot())
+}
+
+// MarshalJSONSorted encodes m as a JSON object whose members are sorted by key.
+//
+// For KVMap[string,V]: the output is the same as MarshalJSON's, which already sorts
+// members because it goes through a plain map. MarshalJSONSorted exists to make that
+// ordering a documented guarantee for string keys, so callers relying on stable
+// bytes, such as API responses or golden files, can say so at the call site. Two
+// maps with the same contents always encode to the same bytes.
+func MarshalJSONSorted[V any](m *KVMap[string, V]) ([]byte, error) {
+	return m.MarshalJSON()
+}
+
+// UnmarshalJSON implements json.Unmarshaler, decoding a JSON object as produced by
+// MarshalJSON.
+//
+// Like encoding/json does for plain maps, UnmarshalJSON adds the decoded members to
+// the existing contents, replacing the values of keys that are already present. A
+// member whose value is null deletes the key, consistent with storing a nil value.
+// The whole input is decoded before the map is touched, so on error the map is left
+// unchanged. Decoding errors wrap ErrMalformedSnapshot and the underlying
+// encoding/json error.
+func (m *KVMap[K, V]) UnmarshalJSON(data []byte) error {
+	var entries map[K]*V
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("%w: %w", ErrMalformedSnapshot, err)
+	}
+
+	for k, v := range entries {
+		m.Store(k, v)
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+// celsius encodes itself as a string with a unit.
+type celsius float64
+
+func (c celsius) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatFloat(float64(c), 'f', 1, 64) + "C")
+}
+
+func TestMarshalJSONUsesValueMarshaler(t *testing.T) {
+	var m KVMap[string, celsius]
+	indoor, outdoor := celsius(21.5), celsius(-3)
+	m.Store("indoor", &indoor)
+	m.Store("outdoor", &outdoor)
+
+	got, err := json.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"indoor":"21.5C","outdoor":"-3.0C"}`; string(got) != want {
+		t.Fatalf("MarshalJSON = %s, want %s", got, want)
+	}
+}
+
+func TestUnmarshalJSONErrors(t *testing.T) {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	for _, tc := range []struct {
+		name  string
+		input string
+		as    any
+	}{
+		{"syntax", `{"1": 1`, &syntaxErr},
+		{"value type", `{"1": "one"}`, &typeErr},
+		{"key type", `{"one": 1}`, &typeErr},
+		{"not an object", `[1, 2]`, &typeErr},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var m KVMap[int, int]
+			keep := 7
+			m.Store(7, &keep)
+
+			// Called directly: json.Unmarshal would reject invalid syntax itself,
+			// before reaching the map.
+			err := m.UnmarshalJSON([]byte(tc.input))
+			if !errors.Is(err, ErrMalformedSnapshot) {
+				t.Fatalf("error %v does not match ErrMalformedSnapshot", err)
+			}
+			if !errors.As(err, tc.as) {
+				t.Fatalf("error %v does not wrap the encoding/json error %T", err, tc.as)
+			}
+			if v, ok := m.Load(7); !ok || v != &keep || m.Len() != 1 {
+				t.Fatal("a failed UnmarshalJSON changed the map")
+			}
+		})
+	}
+
+	var m KVMap[int, int]
+	if err := json.Unmarshal([]byte(`{"1": 1, "2": null}`), &m); err != nil {
+		t.Fatalf("valid input: %v", err)
+	}
+	if v, ok := m.Load(1); !ok || *v != 1 {
+		t.Fatalf("Load(1) = %v, %v after UnmarshalJSON", v, ok)
+	}
+}
+
+func TestMarshalJSONSortedStable(t *testing.T) {
+	keys := []string{"delta", "alpha", "charlie", "echo", "bravo"}
+	const want = `{"alpha":1,"bravo":4,"charlie":2,"delta":0,"echo":3}`
+
+	// Maps filled in different orders, and with different histories, must
+	// encode to the same bytes.
+	for round := 0; round < 10; round++ {
+		var m KVMap[string, int]
+		for i := range keys {
+			j := (i + round) % len(keys)
+			v := j
+			m.Store(keys[j], &v)
+		}
+		if round%2 == 0 {
+			m.Promote()
+		}
+
+		got, err := MarshalJSONSorted(&m)
+		if err != nil {
+			t.Fatalf("MarshalJSONSorted() error = %v", err)
+		}
+		if string(got) != want {
+			t.Fatalf("round %d: MarshalJSONSorted() = %s, want %s", round, got, want)
+		}
+	}
+}
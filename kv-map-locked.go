@@ -0,0 +1,51 @@
+package sync
+
+// LockedKVMap gives access to a KVMap whose lock is already held. It is only
+// obtained from KVMap.WithLock and is only valid until the function passed to
+// WithLock returns.
+type LockedKVMap[K comparable, V any] struct {
+	m *KVMap[K, V]
+}
+
+// WithLock calls f with the map's lock held, passing a handle whose methods operate
+// on the map without taking the lock again.
+//
+// For KVMap[K,V]: f receives a *LockedKVMap[K,V].
+//
+// Every operation that needs the lock (inserting new keys, reading keys that are
+// not yet in the read-only snapshot, Range promotions, and the other slow paths)
+// waits until f returns, so f can perform a multi-key read-modify-write that those
+// operations never observe half-done. Updates of keys already present in the
+// read-only snapshot are lock-free, and Load never locks for such keys: a
+// concurrent Store to an existing key can still interleave with f, and a concurrent
+// Load may see some of f's changes before f returns. Use WithLock to coordinate
+// writers that agree to go through it, not as a full transaction.
+//
+// f must use only the handle it is given. Calling any method of the map itself from
+// f deadlocks, and the handle must not be retained after f returns.
+func (m *KVMap[K, V]) WithLock(f func(tx *LockedKVMap[K, V])) {
+	m.lockWrite()
+	defer m.mu.Unlock()
+
+	f(&LockedKVMap[K, V]{m: m})
+}
+
+// Get returns the value stored for key, like KVMap.Load.
+func (tx *LockedKVMap[K, V]) Get(key K) (value *V, ok bool) {
+	e, ok := tx.m.entryLocked(key)
+	if !ok {
+		return nil, false
+	}
+
+	return e.load()
+}
+
+// Set stores value for key, like KVMap.Store. A nil value deletes the key.
+func (tx *LockedKVMap[K, V]) Set(key K, value *V) {
+	tx.m.swapLocked(key, value)
+}
+
+// Delete removes the entry for key, like KVMap.Delete.
+func (tx *LockedKVMap[K, V]) Delete(key K) {
+	tx.m.deleteLocked(key)
+}
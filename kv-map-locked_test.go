@@ -0,0 +1,60 @@
+package sync
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestWithLockSwapKeys(t *testing.T) {
+	var m KVMap[string, int]
+	a, b := 1, 2
+	m.Store("a", &a)
+	m.Store("b", &b)
+
+	swap := func() {
+		m.WithLock(func(tx *LockedKVMap[string, int]) {
+			va, _ := tx.Get("a")
+			vb, _ := tx.Get("b")
+			tx.Set("a", vb)
+			tx.Set("b", va)
+		})
+	}
+
+	swap()
+	if va, _ := m.Load("a"); va != &b {
+		t.Fatalf("Load(a) = %v after the swap, want %v", va, &b)
+	}
+	if vb, _ := m.Load("b"); vb != &a {
+		t.Fatalf("Load(b) = %v after the swap, want %v", vb, &a)
+	}
+
+	// Swaps that all go through WithLock never lose a value, however they
+	// interleave: the two keys always hold both values between them.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				swap()
+			}
+		}()
+	}
+	wg.Wait()
+
+	va, _ := m.Load("a")
+	vb, _ := m.Load("b")
+	if va == vb || (va != &a && va != &b) || (vb != &a && vb != &b) {
+		t.Fatalf("after concurrent swaps a = %v, b = %v; want %v and %v in some order", va, vb, &a, &b)
+	}
+
+	m.WithLock(func(tx *LockedKVMap[string, int]) {
+		tx.Delete("a")
+		if _, ok := tx.Get("a"); ok {
+			t.Error("Get after Delete in the same WithLock found the key")
+		}
+	})
+	if _, ok := m.Load("a"); ok {
+		t.Fatal("Delete inside WithLock did not delete the key")
+	}
+}
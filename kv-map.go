@@ -1,13 +1,37 @@
 package sync
 
 import (
+	"context"
+	"errors"
+	"maps"
+	"runtime"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"unsafe"
 )
 
 type kvreadOnly[K comparable, V any] struct {
 	m       map[K]*entry[V]
 	amended bool
+
+	// shared is set when the entries of m are shared with another map created by
+	// Fork. They must then not be modified: writers take the lock and give the map
+	// entries of its own first. A shared snapshot is never amended.
+	shared bool
+}
+
+// writable returns the entry for key if read holds it and it may be updated without
+// the lock, that is, unless read is shared with a fork.
+func (read kvreadOnly[K, V]) writable(key K) (e *entry[V], ok bool) {
+	if read.shared {
+		return nil, false
+	}
+
+	e, ok = read.m[key]
+
+	return e, ok
 }
 
 // KVMap is a concurrent map with type-safe keys and values. It behaves like a
@@ -15,24 +39,94 @@ type kvreadOnly[K comparable, V any] struct {
 // are of type V (accessed via pointers to V).
 //
 // The zero KVMap is empty and ready for use. A KVMap must not be copied after
-// first use.
+// first use. go vet reports such copies as it does for sync.Mutex, and builds with
+// the kvmapdebug tag also panic when a method is called on a copied map.
 //
 // KVMap uses the same concurrency mechanism as sync.Map. It is optimized for
 // scenarios where keys are written once and read many times, or where multiple
 // goroutines read/write different keys. In these cases, it can reduce lock
 // contention compared to a map protected by a single Mutex.
+// For maps known to stay at a handful of entries, NewSmallKVMap returns a KVMap that
+// keeps them in a single mutex-guarded map instead.
 //
 // All values in the KVMap are stored as pointers to V. This means methods
 // like Load, Store, etc., use *V. A nil *V value is treated as an absence of
 // value (deleted entry).
 type KVMap[K comparable, V any] struct {
+	// OnPromote, if non-nil, is called every time the dirty map is promoted to
+	// become the read-only map, with the number of entries that were promoted.
+	// Promotions happen after enough lookups miss the read-only map, and on Range
+	// when there are pending writes, so frequent calls signal that the workload
+	// keeps reading keys that were only recently written.
+	//
+	// OnPromote must be set before the map is first used, typically in a
+	// composite literal. It is called with the map's internal lock held, so it
+	// must be fast and must not call any method of the map.
+	OnPromote func(dirtyLen int)
+
+	// CountPaths enables the counters reported by PathStats. They are off by
+	// default because every counted operation then updates a counter shared by
+	// all goroutines, which costs the lock-free read path its scalability.
+	//
+	// Like OnPromote, CountPaths must be set before the map is first used.
+	CountPaths bool
+
+	// copyCheck panics on use of a copied map in builds with the kvmapdebug tag.
+	copyCheck copyChecker
+
+	// small is set by NewSmallKVMap. Every entry then lives in dirty, guarded by
+	// mu, and the read-only map stays empty and amended, so that every operation
+	// takes the locked path.
+	small bool
+
 	mu     sync.Mutex
 	read   atomic.Pointer[kvreadOnly[K, V]]
 	dirty  map[K]*entry[V]
 	misses int
+
+	// writers counts the lock-free updates of entries of the read-only map in
+	// progress, which Fork waits for before it shares them; see beginWrite.
+	writers atomic.Int32
+
+	// size approximates the number of live entries; see ApproxLen.
+	size atomic.Int64
+
+	// flights holds the initializations in progress; see LoadOrInitOnce.
+	flights flightGroup[K, V]
+
+	// grown is notified whenever size increases; see WaitForSize.
+	grown notifier
+
+	// paths holds the counters reported by PathStats.
+	paths struct {
+		fastReads, slowReads, writes atomic.Uint64
+	}
+}
+
+// NewSmallKVMap returns an empty KVMap in small-map mode, for maps known to stay at a
+// handful of entries.
+//
+// In this mode the map does without the read-only snapshot: every entry lives in a
+// single Go map guarded by the map's mutex, and every operation, Load included,
+// takes the lock. At a few entries, and especially when keys come and go, that
+// costs less than keeping the snapshot and the dirty map in step and promoting one
+// to the other; with many entries, or many goroutines reading established keys at
+// once, the default mode is faster. The map has the whole KVMap API with the same
+// semantics, including Range callbacks that modify the map, so switching a map
+// between the two modes only changes its construction. The mode is fixed for the
+// life of the map. Fork carries it over; the maps built by other functions, such as
+// Invert or KVMapBuilder.Build, use the default mode. OnPromote is never called in
+// small-map mode, and PathStats counts every read as a slow one.
+func NewSmallKVMap[K comparable, V any]() *KVMap[K, V] {
+	m := &KVMap[K, V]{small: true}
+	m.replaceLocked(nil)
+
+	return m
 }
 
 func (m *KVMap[K, V]) loadReadOnly() kvreadOnly[K, V] {
+	m.copyCheck.check()
+
 	if p := m.read.Load(); p != nil {
 		return *p
 	}
@@ -59,6 +153,7 @@ func (m *KVMap[K, V]) Load(key K) (value *V, ok bool) {
 	read := m.loadReadOnly()
 	e, ok := read.m[key]
 	if !ok && read.amended {
+		m.countPath(&m.paths.slowReads)
 		m.mu.Lock()
 
 		read = m.loadReadOnly()
@@ -70,6 +165,8 @@ func (m *KVMap[K, V]) Load(key K) (value *V, ok bool) {
 		}
 
 		m.mu.Unlock()
+	} else {
+		m.countPath(&m.paths.fastReads)
 	}
 
 	if !ok {
@@ -79,6 +176,189 @@ func (m *KVMap[K, V]) Load(key K) (value *V, ok bool) {
 	return e.load()
 }
 
+// LoadForUpdate returns the pointer stored for key, for use as the old argument of
+// a later CompareAndSwap or CompareAndDelete.
+//
+// It is Load under a name that states the contract: ptr is the very pointer held by
+// the map, not a copy, so the compare-and-swap succeeds exactly if nobody stored a
+// different pointer for the key in between. The usual read-modify-write loop is
+//
+//	for {
+//		old, ok := m.LoadForUpdate(key)
+//		if !ok {
+//			break
+//		}
+//		next := update(*old)
+//		if m.CompareAndSwap(key, old, &next) {
+//			break
+//		}
+//	}
+//
+// The pointed-to value must not be modified; build the new value separately.
+func (m *KVMap[K, V]) LoadForUpdate(key K) (ptr *V, ok bool) {
+	return m.Load(key)
+}
+
+// Contains reports whether the map holds a value for key.
+//
+// For KVMap[K,V]: 'key' is of type K. It is equivalent to calling Load and
+// ignoring the value, with the same locking behavior.
+func (m *KVMap[K, V]) Contains(key K) bool {
+	_, ok := m.Load(key)
+	return ok
+}
+
+// LoadOrElse returns the value stored for key, or the result of elseFn if the key is
+// absent. The result of elseFn is never stored, so the next lookup of the key misses
+// again; use LoadOrInitOnce to cache it instead. elseFn is not called when the key
+// is present.
+func (m *KVMap[K, V]) LoadOrElse(key K, elseFn func() *V) *V {
+	if v, ok := m.Load(key); ok {
+		return v
+	}
+
+	return elseFn()
+}
+
+// ContainsAll reports whether the map holds a value for every one of keys. It stops
+// at the first missing key, and returns true when keys is empty.
+//
+// Each key is looked up with Contains on its own, so with concurrent writers the
+// answer is not a snapshot: a key found present may be deleted before the next one
+// is checked.
+func (m *KVMap[K, V]) ContainsAll(keys ...K) bool {
+	for _, k := range keys {
+		if !m.Contains(k) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ContainsAny reports whether the map holds a value for at least one of keys. It
+// stops at the first key found, and returns false when keys is empty. As with
+// ContainsAll, each key is checked separately.
+func (m *KVMap[K, V]) ContainsAny(keys ...K) bool {
+	for _, k := range keys {
+		if m.Contains(k) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ContainsFast reports whether key is present in the map's read-only snapshot. It
+// never takes the lock.
+//
+// For KVMap[K,V]: 'key' is of type K.
+//
+// ContainsFast trades accuracy for speed. Keys stored recently enough that they only
+// live in the dirty map are reported as absent until the dirty map is promoted,
+// which happens after enough missed lookups or on the next Range. Deletions, on the
+// other hand, are always reflected. A false result therefore means "not present, or
+// inserted recently", while true is reliable at the moment of the call. Use it for
+// hot-path checks that tolerate false negatives, and Contains everywhere else. A
+// small-mode map has no snapshot, so there ContainsFast is Contains and takes the
+// lock.
+func (m *KVMap[K, V]) ContainsFast(key K) bool {
+	if m.small {
+		return m.Contains(key)
+	}
+
+	e, ok := m.loadReadOnly().m[key]
+	if !ok {
+		return false
+	}
+
+	_, ok = e.load()
+
+	return ok
+}
+
+// Len returns the number of live entries in the map.
+//
+// Len counts the entries, so it is O(n) in the size of the map. When the map has no
+// pending writes it only reads the read-only snapshot and does not lock; otherwise it
+// counts the dirty map under the lock. With concurrent writers, the result is the
+// size at some point during the call.
+func (m *KVMap[K, V]) Len() int {
+	read := m.loadReadOnly()
+	if !read.amended {
+		return countLive(read.m)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.lenLocked()
+}
+
+// ApproxLen returns the number of live entries as tracked by an internal counter.
+//
+// Unlike Len, ApproxLen is O(1) and never locks: it is a single atomic load, cheap
+// enough for high-frequency gauges. Every operation that makes a key go from absent
+// to present increments the counter and every operation that makes a key go from
+// present to absent decrements it; updates of existing keys leave it unchanged.
+//
+// The counter is eventually consistent. While writers are active it may lag behind
+// the actual contents, and an update that races with an operation swapping out the
+// whole map (Clear, ReplaceAll) may leave it off by the number of such racing
+// updates. Once writers settle it agrees with Len, barring such races. Use Len when
+// an exact count matters.
+func (m *KVMap[K, V]) ApproxLen() int64 {
+	if n := m.size.Load(); n > 0 {
+		return n
+	}
+
+	return 0
+}
+
+// WaitForSize blocks until the map holds at least n entries or ctx is done, and
+// returns nil or ctx.Err() respectively.
+//
+// The size is the one reported by ApproxLen, so WaitForSize is O(1) per check and
+// shares its caveats: an update racing with Clear or ReplaceAll may leave it off.
+// Waiters do not poll: every operation that adds a key, or installs new contents
+// with ReplaceAll and the like, wakes them to check again, at the cost of a single
+// atomic load while nobody is waiting. It suits test synchronization and simple
+// backpressure.
+func (m *KVMap[K, V]) WaitForSize(ctx context.Context, n int) error {
+	m.grown.add(1)
+	defer m.grown.add(-1)
+
+	for {
+		ch := m.grown.wait()
+		if m.ApproxLen() >= int64(n) {
+			return nil
+		}
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// PathStats reports how many lookups were answered from the read-only snapshot
+// without locking, how many had to take the lock to consult the dirty map, and how
+// many write operations were made. It only counts while CountPaths is set.
+//
+// Lookups are counted by Load, and by every method that looks a key up through it.
+// Writes are counted by Store, Swap, LoadOrStore, LoadAndDelete, Delete,
+// CompareAndSwap and CompareAndDelete, again including the calls other methods make.
+// A workload that suits the map shows few slow reads compared to fast ones; a high
+// share of slow reads means lookups keep hitting keys too recent to have been
+// promoted, and a plain mutex-guarded map or RWKVMap may serve it better.
+//
+// The three counters are read independently, so under concurrent use they need
+// not add up to a consistent moment in time.
+func (m *KVMap[K, V]) PathStats() (fastReads, slowReads, writes uint64) {
+	return m.paths.fastReads.Load(), m.paths.slowReads.Load(), m.paths.writes.Load()
+}
+
 // Store sets the value for a key in the map.
 //
 // For KVMap[K,V]: 'key' is of type K, and 'value' is *V (a pointer to V).
@@ -90,6 +370,13 @@ func (m *KVMap[K, V]) Load(key K) (value *V, ok bool) {
 // The stored value must be a pointer of type *V. A nil pointer value will
 // effectively remove the key from the map (as if Delete were called).
 //
+// The map keeps the pointer itself, never a copy of *value, so storing costs no
+// allocation beyond the one the caller made. In return, the pointed-to value is
+// shared with every goroutine that loads the key: once stored, it must not be
+// modified, or recycled through a pool, until it has been replaced or deleted and
+// no reader can still hold it. Store a new pointer instead of writing through an
+// old one.
+//
 // Store is safe to call concurrently from multiple goroutines. It may block
 // briefly if another operation is writing to the map’s internal structures.
 func (m *KVMap[K, V]) Store(key K, value *V) {
@@ -114,13 +401,58 @@ func (m *KVMap[K, V]) Clear() {
 	defer m.mu.Unlock()
 
 	read = m.loadReadOnly()
-	if len(read.m) > 0 || read.amended {
+	if !m.small && (len(read.m) > 0 || read.amended) {
 		m.read.Store(&kvreadOnly[K, V]{})
 	}
 
 	clear(m.dirty)
 
 	m.misses = 0
+	m.size.Store(0)
+}
+
+// ClearCount removes all entries from the map and returns the number of live
+// entries it removed.
+//
+// Unlike Clear, which swaps in an empty snapshot and may let a racing update slip
+// past, ClearCount detaches every entry under the lock the way DrainInto does: each
+// value present when its entry is detached is counted, and a concurrent write
+// either lands before and is counted, or lands after, in the emptied map. The count
+// is therefore exact for the entries it removed. It is O(n).
+func (m *KVMap[K, V]) ClearCount() (removed int) {
+	m.lockWrite()
+	defer m.mu.Unlock()
+
+	for _, e := range m.entriesLocked() {
+		if _, ok := e.detachLocked(); ok {
+			removed++
+		}
+	}
+
+	m.replaceLocked(nil)
+
+	return removed
+}
+
+// ClearFunc removes all entries from the map, like Clear, and then calls cleanup for
+// each entry that was removed.
+//
+// For KVMap[K,V]: cleanup receives (key K, value *V).
+//
+// Use ClearFunc when values own resources, such as open files or connections, that
+// must be released when they leave the map. The entries are detached under the lock
+// the same way DrainInto does it, so every value is handed to cleanup exactly once,
+// even if other goroutines update the map concurrently. cleanup runs only after all
+// entries have been detached and the lock has been released, so it may use the map
+// freely; keys stored in the meantime belong to the new contents and are not passed
+// to it.
+func (m *KVMap[K, V]) ClearFunc(cleanup func(key K, value *V)) {
+	removed := make(map[K]*V)
+	m.DrainInto(removed)
+
+	for k, v := range removed {
+		cleanup(k, v)
+	}
 }
 
 // LoadOrStore returns the existing value for the key if present. Otherwise, it stores
@@ -145,17 +477,32 @@ func (m *KVMap[K, V]) Clear() {
 // This operation locks the map only briefly if the key is missing, to set up the new entry.
 // It is safe for concurrent use by multiple goroutines.
 func (m *KVMap[K, V]) LoadOrStore(key K, value *V) (actual *V, loaded bool) {
-	read := m.loadReadOnly()
-	if e, ok := read.m[key]; ok {
-		actual, loaded, ok := e.tryLoadOrStore(value)
-		if ok {
-			return actual, loaded
+	m.countPath(&m.paths.writes)
+
+	read := m.beginWrite()
+	e, ok := read.writable(key)
+	if ok {
+		actual, loaded, ok = e.tryLoadOrStore(value)
+	}
+	m.endWrite()
+
+	if ok {
+		if !loaded {
+			m.trackLen(nil, value)
 		}
+		return actual, loaded
 	}
 
-	m.mu.Lock()
+	m.lockWrite()
+	actual, loaded = m.loadOrStoreLocked(key, value)
+	m.mu.Unlock()
 
-	read = m.loadReadOnly()
+	return actual, loaded
+}
+
+// loadOrStoreLocked is the slow path of LoadOrStore. m.mu must be held.
+func (m *KVMap[K, V]) loadOrStoreLocked(key K, value *V) (actual *V, loaded bool) {
+	read := m.loadReadOnly()
 	if e, ok := read.m[key]; ok {
 		if e.unexpungeLocked() {
 			m.dirty[key] = e
@@ -171,15 +518,190 @@ func (m *KVMap[K, V]) LoadOrStore(key K, value *V) (actual *V, loaded bool) {
 			m.read.Store(&kvreadOnly[K, V]{m: read.m, amended: true})
 		}
 
+		m.sweepLocked()
 		m.dirty[key] = newEntry(value)
 		actual, loaded = value, false
 	}
 
-	m.mu.Unlock()
+	if !loaded {
+		m.trackLen(nil, value)
+	}
 
 	return actual, loaded
 }
 
+// LoadOrStoreDetailed is like LoadOrStore, but additionally reports whether this
+// particular call created the entry.
+//
+// For KVMap[K,V]: (key K, value *V) -> (actual *V, loaded bool, created bool).
+//
+// actual and loaded have the same meaning as for LoadOrStore. created is true only
+// if this call inserted value into the map. When several goroutines race to insert
+// the same key, exactly one of them observes created == true, even if they all pass
+// the same pointer, so comparing actual with value is not needed (and would not
+// tell the callers apart) to find out which call won.
+//
+// The only case where loaded and created are both false is a nil value: LoadOrStore
+// returns it as if it had been stored, but a nil value is an absent value, so nothing
+// was created.
+func (m *KVMap[K, V]) LoadOrStoreDetailed(key K, value *V) (actual *V, loaded bool, created bool) {
+	actual, loaded = m.LoadOrStore(key, value)
+
+	return actual, loaded, !loaded && value != nil
+}
+
+// LoadOrStoreBounded is like LoadOrStore, but refuses to add a new key once the map
+// holds max entries or more.
+//
+// For KVMap[K,V]: (key K, value *V, max int) -> (actual *V, loaded bool, full bool).
+//
+// If the key is present, its value is returned with loaded == true, regardless of
+// the size of the map. If it is absent and the map has fewer than max entries, value
+// is stored and returned with loaded == false. Otherwise nothing is stored and
+// LoadOrStoreBounded returns (nil, false, true).
+//
+// The size check and the insert happen under the map's lock, so concurrent calls
+// cannot push the map past max between them. The check counts the live entries, as
+// Len does, which is O(n) for every insert of a new key; the counter behind
+// ApproxLen is not consulted, since it may drift either way and would let the map
+// grow past max or refuse keys below it. Keys that were deleted but still have an
+// entry in the read-only snapshot can be stored again without the lock, though, so a
+// concurrent Store of such a key may briefly take the map over the limit.
+func (m *KVMap[K, V]) LoadOrStoreBounded(key K, value *V, max int) (actual *V, loaded bool, full bool) {
+	if e, ok := m.loadReadOnly().m[key]; ok {
+		if v, ok := e.load(); ok {
+			return v, true, false
+		}
+	}
+
+	m.lockWrite()
+	defer m.mu.Unlock()
+
+	if e, ok := m.entryLocked(key); ok {
+		if v, ok := e.load(); ok {
+			return v, true, false
+		}
+	}
+
+	if m.lenLocked() >= max {
+		return nil, false, true
+	}
+
+	actual, loaded = m.loadOrStoreLocked(key, value)
+
+	return actual, loaded, false
+}
+
+// LoadOrInitOnce returns the value stored for key, initializing it with init if the
+// key is absent.
+//
+// For KVMap[K,V]: (key K, init func() (*V, error)) -> (*V, error).
+//
+// It works like a sync.Once per key that can be retried. When several goroutines
+// miss the same key at once, only one of them calls init and the others wait for it
+// and share its result. If init succeeds, its value is stored and every later call
+// returns it without calling init again. If init fails, nothing is stored: the
+// callers waiting on that attempt receive its error, and the next call tries again.
+// A nil value with a nil error is returned as is and not stored either.
+//
+// If init panics, the panic propagates to the goroutine that called it, and the
+// waiting goroutines start over as if the key had been missed just now. A value
+// stored for key by other means while init runs takes precedence over the one init
+// returns.
+func (m *KVMap[K, V]) LoadOrInitOnce(key K, init func() (*V, error)) (*V, error) {
+	for {
+		if v, ok := m.Load(key); ok {
+			return v, nil
+		}
+
+		f, leader := m.flights.join(key)
+		if leader {
+			return m.fly(key, f, init)
+		}
+
+		<-f.done
+		if f.ok {
+			return f.value, f.err
+		}
+	}
+}
+
+// LoadOrComputeSingleFlight returns the value stored for key, computing and storing
+// it if the key is absent, with at most one computation per key in progress at a
+// time.
+//
+// For KVMap[K,V]: (ctx context.Context, key K, compute func(context.Context) (*V, error)) -> (*V, error).
+//
+// It is LoadOrInitOnce with cancellation, in the spirit of
+// golang.org/x/sync/singleflight scoped to the map: when many goroutines miss the
+// same key at once, one of them runs compute with its own ctx and the others wait
+// for its result instead of piling onto the backend. A waiter whose ctx is done
+// stops waiting and returns ctx.Err(), without affecting the computation. The
+// computation itself is only canceled through the ctx of the goroutine running it.
+// If compute fails with that ctx's error once it is done, the error is returned to
+// that goroutine only: the waiters of the attempt start over, and one of them runs
+// compute with its own ctx. Other errors are shared with the waiters of the
+// attempt, and the next call computes again. Successful results are stored,
+// failures are not, as in LoadOrInitOnce, and flights are shared with it.
+func (m *KVMap[K, V]) LoadOrComputeSingleFlight(ctx context.Context, key K, compute func(context.Context) (*V, error)) (*V, error) {
+	for {
+		if v, ok := m.Load(key); ok {
+			return v, nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		f, leader := m.flights.join(key)
+		if leader {
+			return m.fly(key, f, func() (*V, error) {
+				v, err := compute(ctx)
+				if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+					f.canceled = true
+				}
+
+				return v, err
+			})
+		}
+
+		select {
+		case <-f.done:
+			if f.ok {
+				return f.value, f.err
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// fly runs fn as the leader of flight f for key, storing its value on success, and
+// publishes the outcome to the waiters.
+func (m *KVMap[K, V]) fly(key K, f *flight[V], fn func() (*V, error)) (value *V, err error) {
+	ok := false
+	defer func() {
+		m.flights.finish(key, f, value, err, ok)
+	}()
+
+	// The previous flight may have stored the value after our Load missed it.
+	if v, loaded := m.Load(key); loaded {
+		ok = true
+		return v, nil
+	}
+
+	value, err = fn()
+	if err != nil {
+		value = nil
+	} else if value != nil {
+		value, _ = m.LoadOrStore(key, value)
+	}
+
+	ok = true
+
+	return value, err
+}
+
 // LoadAndDelete deletes the entry for a key, returning the value that was present and
 // a boolean indicating if the key was found.
 //
@@ -194,10 +716,21 @@ func (m *KVMap[K, V]) LoadOrStore(key K, value *V) (actual *V, loaded bool) {
 //
 // Safe for concurrent use. It will lock the map briefly to perform the deletion.
 func (m *KVMap[K, V]) LoadAndDelete(key K) (value *V, loaded bool) {
-	read := m.loadReadOnly()
-	e, ok := read.m[key]
-	if !ok && read.amended {
-		m.mu.Lock()
+	m.countPath(&m.paths.writes)
+
+	read := m.beginWrite()
+	e, ok := read.writable(key)
+	if ok {
+		value, loaded = e.delete()
+	}
+	m.endWrite()
+
+	if !ok {
+		if !read.amended && !read.shared {
+			return nil, false
+		}
+
+		m.lockWrite()
 
 		read = m.loadReadOnly()
 		e, ok = read.m[key]
@@ -208,14 +741,87 @@ func (m *KVMap[K, V]) LoadAndDelete(key K) (value *V, loaded bool) {
 
 			m.missLocked()
 		}
+		if ok {
+			value, loaded = e.delete()
+		}
+
 		m.mu.Unlock()
 	}
 
-	if ok {
-		return e.delete()
+	if loaded {
+		m.trackLen(value, nil)
 	}
 
-	return nil, false
+	return value, loaded
+}
+
+// LoadAndDeleteIf deletes the entry for a key if its value satisfies pred, returning
+// the value that was examined.
+//
+// For KVMap[K,V]: (key K, pred func(*V) bool) -> (value *V, deleted bool).
+//
+// If the key is absent, pred is not called and LoadAndDeleteIf returns (nil, false).
+// Otherwise pred is called with the current value. If it returns true, the entry is
+// removed with CompareAndDelete and (value, true) is returned; if it returns false,
+// the entry is left in place and (value, false) is returned.
+//
+// If another goroutine replaces or deletes the value between the call to pred and
+// the deletion, the deletion does not happen and the whole check starts over with
+// the new value. pred may therefore be called several times under contention, and
+// must not have side effects.
+func (m *KVMap[K, V]) LoadAndDeleteIf(key K, pred func(value *V) bool) (value *V, deleted bool) {
+	for {
+		v, ok := m.Load(key)
+		if !ok {
+			return nil, false
+		}
+
+		if !pred(v) {
+			return v, false
+		}
+
+		if m.CompareAndDelete(key, v) {
+			return v, true
+		}
+	}
+}
+
+// UpdateAndGet replaces the value for key with the result of f and returns the value
+// it stored.
+//
+// For KVMap[K,V]: (key K, f func(old *V, loaded bool) *V) -> (new *V, ok bool).
+//
+// f receives the current value and whether the key was present, and returns the
+// value to store. The result is installed with CompareAndSwap, or with LoadOrStore
+// if the key was absent, and the whole step is retried if another goroutine changed
+// the key in the meantime. Updates of keys in the read-only snapshot therefore never
+// take the lock; only inserting a new key does. If f returns nil, the key is deleted
+// instead and UpdateAndGet returns (nil, false); otherwise it returns (new, true).
+//
+// Under contention f may run several times before one of its results wins, so it
+// must be a pure function of its arguments and must not modify *old.
+func (m *KVMap[K, V]) UpdateAndGet(key K, f func(old *V, loaded bool) *V) (new *V, ok bool) {
+	for {
+		old, loaded := m.Load(key)
+		new = f(old, loaded)
+
+		switch {
+		case !loaded && new == nil:
+			return nil, false
+		case !loaded:
+			if _, loaded := m.LoadOrStore(key, new); !loaded {
+				return new, true
+			}
+		case new == nil:
+			if m.CompareAndDelete(key, old) {
+				return nil, false
+			}
+		default:
+			if m.CompareAndSwap(key, old, new) {
+				return new, true
+			}
+		}
+	}
 }
 
 // Delete removes the entry for a key from the map.
@@ -246,19 +852,30 @@ func (m *KVMap[K, V]) Delete(key K) {
 // Swap provides a way to get the old value while simultaneously setting a new value, all in one atomic operation.
 // It is safe for concurrent use; it locks the map briefly to perform the swap.
 func (m *KVMap[K, V]) Swap(key K, value *V) (previous *V, loaded bool) {
-	read := m.loadReadOnly()
-	if e, ok := read.m[key]; ok {
-		if v, ok := e.trySwap(value); ok {
-			if v == nil {
-				return nil, false
-			}
-			return v, true
-		}
+	m.countPath(&m.paths.writes)
+
+	read := m.beginWrite()
+	e, ok := read.writable(key)
+	if ok {
+		previous, ok = e.trySwap(value)
 	}
+	m.endWrite()
 
-	m.mu.Lock()
+	if ok {
+		m.trackLen(previous, value)
+		return previous, previous != nil
+	}
 
-	read = m.loadReadOnly()
+	m.lockWrite()
+	previous, loaded = m.swapLocked(key, value)
+	m.mu.Unlock()
+
+	return previous, loaded
+}
+
+// swapLocked is the slow path of Swap. m.mu must be held.
+func (m *KVMap[K, V]) swapLocked(key K, value *V) (previous *V, loaded bool) {
+	read := m.loadReadOnly()
 	if e, ok := read.m[key]; ok {
 		if e.unexpungeLocked() {
 			m.dirty[key] = e
@@ -278,13 +895,53 @@ func (m *KVMap[K, V]) Swap(key K, value *V) (previous *V, loaded bool) {
 			m.read.Store(&kvreadOnly[K, V]{m: read.m, amended: true})
 		}
 
+		m.sweepLocked()
 		m.dirty[key] = newEntry(value)
 	}
-	m.mu.Unlock()
+
+	m.trackLen(previous, value)
 
 	return previous, loaded
 }
 
+// Exchange stores value for key and returns the value it replaced.
+//
+// For KVMap[K,V]: (key K, value *V) -> (previous *V, had bool).
+//
+// had reports whether the key held a live value before the call, and previous is
+// that value, or nil if there was none. Both depend only on the state before the
+// call: storing a nil value deletes the key, as with Store, and still reports
+// what was deleted. Exchange is the same operation as Swap under a name that says
+// what it returns; prefer it in new code that needs the previous value.
+func (m *KVMap[K, V]) Exchange(key K, value *V) (previous *V, had bool) {
+	return m.Swap(key, value)
+}
+
+// TakeAndReset replaces the value stored for key with placeholder and returns the
+// value it replaced.
+//
+// For KVMap[K,V]: (key K, placeholder *V) -> (taken *V, ok bool).
+//
+// It supports double buffering: producers accumulate into the value stored for
+// key, replacing it by CompareAndSwap, while a consumer periodically takes the
+// accumulated value and leaves a fresh placeholder, typically an empty buffer. The
+// replacement is itself a CompareAndSwap against the value just loaded, retried
+// until it wins, so every producer update lands either in taken or in the
+// placeholder, never in neither. Unlike Exchange, an absent key is left absent and
+// TakeAndReset returns (nil, false). A nil placeholder deletes the key.
+func (m *KVMap[K, V]) TakeAndReset(key K, placeholder *V) (taken *V, ok bool) {
+	for {
+		cur, ok := m.Load(key)
+		if !ok {
+			return nil, false
+		}
+
+		if m.CompareAndSwap(key, cur, placeholder) {
+			return cur, true
+		}
+	}
+}
+
 // CompareAndSwap swaps the old and new values for a key if the current value matches old.
 //
 // For KVMap[K,V]: types are (key K, old *V, new *V) -> (swapped bool).
@@ -306,22 +963,30 @@ func (m *KVMap[K, V]) Swap(key K, value *V) (previous *V, loaded bool) {
 // This operation is safe for concurrent use. It may lock the map if it has to check a key in the
 // dirty map, but in the common case it will just use atomic reads.
 func (m *KVMap[K, V]) CompareAndSwap(key K, old, new *V) (swapped bool) {
-	read := m.loadReadOnly()
-	if e, ok := read.m[key]; ok {
-		return e.tryCompareAndSwap(old, new)
-	} else if !read.amended {
-		return false
+	m.countPath(&m.paths.writes)
+
+	read := m.beginWrite()
+	e, ok := read.writable(key)
+	if ok {
+		swapped = m.compareAndSwapEntry(e, old, new)
 	}
+	m.endWrite()
 
-	m.mu.Lock()
+	if ok {
+		return swapped
+	} else if !read.amended && !read.shared {
+		return false
+	}
+
+	m.lockWrite()
 	defer m.mu.Unlock()
 
 	read = m.loadReadOnly()
 	swapped = false
 	if e, ok := read.m[key]; ok {
-		swapped = e.tryCompareAndSwap(old, new)
+		swapped = m.compareAndSwapEntry(e, old, new)
 	} else if e, ok := m.dirty[key]; ok {
-		swapped = e.tryCompareAndSwap(old, new)
+		swapped = m.compareAndSwapEntry(e, old, new)
 
 		m.missLocked()
 	}
@@ -329,6 +994,38 @@ func (m *KVMap[K, V]) CompareAndSwap(key K, old, new *V) (swapped bool) {
 	return swapped
 }
 
+// StoreIfAbsentOrMatch stores new for key if the key is absent or its current value
+// is match, and reports whether it did.
+//
+// For KVMap[K,V]: (key K, match *V, new *V) -> (stored bool).
+//
+// It implements "acquire or renew my lease" in one step: a holder passes the lease
+// value it stored last as match and a fresh one as new, and succeeds if nobody holds
+// the lease or it still holds it itself. The comparison is pointer equality, as in
+// CompareAndSwap. If another goroutine takes or changes the key between the check
+// and the store, the check is repeated against the new state. A nil new releases
+// the lease on a match, and trivially succeeds on an absent key.
+func (m *KVMap[K, V]) StoreIfAbsentOrMatch(key K, match, new *V) (stored bool) {
+	for {
+		cur, ok := m.Load(key)
+		if !ok {
+			if _, loaded := m.LoadOrStore(key, new); !loaded {
+				return true
+			}
+
+			continue
+		}
+
+		if cur != match {
+			return false
+		}
+
+		if m.CompareAndSwap(key, cur, new) {
+			return true
+		}
+	}
+}
+
 // CompareAndDelete deletes the entry for a key if its current value matches old.
 //
 // For KVMap[K,V]: (key K, old *V) -> (deleted bool).
@@ -346,10 +1043,21 @@ func (m *KVMap[K, V]) CompareAndSwap(key K, old, new *V) (swapped bool) {
 //
 // Safe for concurrent use. It will acquire a lock if needed to synchronize the deletion.
 func (m *KVMap[K, V]) CompareAndDelete(key K, old *V) (deleted bool) {
-	read := m.loadReadOnly()
-	e, ok := read.m[key]
-	if !ok && read.amended {
-		m.mu.Lock()
+	m.countPath(&m.paths.writes)
+
+	read := m.beginWrite()
+	e, ok := read.writable(key)
+	if ok {
+		deleted = e.tryCompareAndDelete(old)
+	}
+	m.endWrite()
+
+	if !ok {
+		if !read.amended && !read.shared {
+			return false
+		}
+
+		m.lockWrite()
 
 		read = m.loadReadOnly()
 		e, ok = read.m[key]
@@ -358,21 +1066,16 @@ func (m *KVMap[K, V]) CompareAndDelete(key K, old *V) (deleted bool) {
 
 			m.missLocked()
 		}
+		deleted = ok && e.tryCompareAndDelete(old)
 
 		m.mu.Unlock()
 	}
-	for ok {
-		p := e.p.Load()
-		if p == nil || p == (*V)(expunged) || p != old {
-			return false
-		}
 
-		if e.p.CompareAndSwap(p, nil) {
-			return true
-		}
+	if deleted {
+		m.trackLen(old, nil)
 	}
 
-	return false
+	return deleted
 }
 
 // Range calls the given function sequentially for each key and value present in the map.
@@ -397,6 +1100,11 @@ func (m *KVMap[K, V]) CompareAndDelete(key K, old *V) (deleted bool) {
 // the map in ways that fundamentally disrupt the iteration (it’s okay to delete the current key or add new keys, but avoid patterns
 // like recursively calling Range within Range).
 //
+// Deleting every visited key from f (with Delete, LoadAndDelete or CompareAndDelete) is a supported way to drain
+// the map. Range iterates over an immutable snapshot of the keys that it promotes before the first call to f, and
+// deletions only mark entries as deleted without changing that snapshot, so every key present when Range started
+// is visited exactly once and the map is empty afterwards, apart from keys inserted by other goroutines meanwhile.
+//
 // If f panics, the panic propagates out of Range and the map's state is safe (no partial holds on locks).
 func (m *KVMap[K, V]) Range(f func(key K, value *V) bool) {
 	read := m.loadReadOnly()
@@ -404,14 +1112,10 @@ func (m *KVMap[K, V]) Range(f func(key K, value *V) bool) {
 		m.mu.Lock()
 
 		read = m.loadReadOnly()
-		if read.amended {
-			read = kvreadOnly[K, V]{m: m.dirty}
-			copyRead := read
-
-			m.read.Store(&copyRead)
-
-			m.dirty = nil
-			m.misses = 0
+		if m.small {
+			read = kvreadOnly[K, V]{m: maps.Clone(m.dirty)}
+		} else if read.amended {
+			read = m.promoteLocked()
 		}
 
 		m.mu.Unlock()
@@ -429,16 +1133,820 @@ func (m *KVMap[K, V]) Range(f func(key K, value *V) bool) {
 	}
 }
 
+// RangeParallel calls f for each key and value present in the map, spreading the
+// calls across a pool of worker goroutines.
+//
+// For KVMap[K,V]: f receives (key K, value *V). Unlike Range, f has no way to stop
+// the iteration early.
+//
+// The entries are produced by Range, so the same consistency notes apply: no key is
+// visited more than once, and keys inserted or deleted concurrently may or may not be
+// visited. RangeParallel returns only after every dispatched call to f has completed.
+//
+// workers is the size of the pool; values below 1 are treated as 1. Because f is
+// invoked from several goroutines at once, it must be safe for concurrent use.
+//
+// If f panics, the remaining entries are still drained by the other workers, and the
+// first panic value is re-raised from RangeParallel once the pool has finished.
+func (m *KVMap[K, V]) RangeParallel(workers int, f func(key K, value *V)) {
+	rangeParallel(workers, m.Range, f)
+}
+
+// Rename moves the value stored under oldKey to newKey.
+//
+// For KVMap[K,V]: (oldKey K, newKey K) -> (moved bool).
+//
+// The move only happens if oldKey holds a value and newKey does not: Rename never
+// overwrites an existing entry. If oldKey is absent, or newKey is already present,
+// the map is left unchanged and Rename returns false. Renaming a key to itself
+// therefore always reports false.
+//
+// Rename holds the map's lock for the whole operation, so it is atomic with respect
+// to every other operation that takes the lock. Loads of keys already in the
+// read-only snapshot never lock, though: a concurrent reader may briefly find the
+// value under both keys, but it is never missing from both. If oldKey is changed
+// by another goroutine while the move is in progress, the move is undone and
+// Rename returns false.
+func (m *KVMap[K, V]) Rename(oldKey, newKey K) (moved bool) {
+	m.lockWrite()
+	defer m.mu.Unlock()
+
+	e, ok := m.entryLocked(oldKey)
+	if !ok {
+		return false
+	}
+
+	value, ok := e.load()
+	if !ok {
+		return false
+	}
+
+	if _, loaded := m.loadOrStoreLocked(newKey, value); loaded {
+		return false
+	}
+
+	if !m.compareAndSwapEntry(e, value, nil) {
+		if ne, ok := m.entryLocked(newKey); ok {
+			m.compareAndSwapEntry(ne, value, nil)
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// MoveFunc moves every entry for which pred returns true from m to dst, and returns
+// the number of entries moved.
+//
+// For KVMap[K,V]: (dst *KVMap[K,V], pred func(key K, value *V) bool) -> (moved int).
+//
+// The entries are visited with Range. Each matching entry is removed from m with
+// CompareAndDelete against the value pred examined and then stored in dst, so a
+// value replaced in m after pred saw it is left in m, and no value is moved twice
+// or dropped. The move of a single key is not atomic as a whole: between the delete
+// and the store, the key is briefly absent from both maps. A key already present in
+// dst is overwritten.
+func (m *KVMap[K, V]) MoveFunc(dst *KVMap[K, V], pred func(key K, value *V) bool) (moved int) {
+	m.Range(func(key K, value *V) bool {
+		if pred(key, value) && m.CompareAndDelete(key, value) {
+			dst.Store(key, value)
+			moved++
+		}
+
+		return true
+	})
+
+	return moved
+}
+
+// RangeSnapshot calls f sequentially for each key that was present in the map at
+// the moment RangeSnapshot was called. If f returns false, the iteration stops.
+//
+// For KVMap[K,V]: f receives (key K, value *V).
+//
+// Unlike Range, RangeSnapshot gives a hard guarantee about the key set: it records
+// the live keys under the map's lock before the first call to f, and keys inserted
+// after that point are never visited. The value passed to f is loaded again just
+// before the call, so it reflects updates made since the snapshot, and keys deleted
+// since the snapshot are skipped.
+//
+// Taking the snapshot costs one allocation proportional to the number of entries,
+// so prefer Range when the weaker guarantees are acceptable.
+func (m *KVMap[K, V]) RangeSnapshot(f func(key K, value *V) bool) {
+	m.mu.Lock()
+	keys := m.keysLocked()
+	m.mu.Unlock()
+
+	for _, k := range keys {
+		v, ok := m.Load(k)
+		if !ok {
+			continue
+		}
+
+		if !f(k, v) {
+			break
+		}
+	}
+}
+
+// TrimDirty releases memory held by deleted entries.
+//
+// Go maps never shrink, so after a burst of inserts followed by many deletes the
+// map's internal storage keeps the size it had at its peak. TrimDirty reallocates
+// that storage with room for the live entries only. If there is a dirty map, it is
+// the one rebuilt; otherwise the dirty map has already been promoted, and the
+// read-only map it became is rebuilt instead. Deleted entries are dropped in the
+// process, and the values of live entries are not affected.
+//
+// TrimDirty holds the map's lock while it copies the live entries, which is O(n) in
+// the number of entries. It is a cheaper, more targeted operation than rebuilding the
+// whole map, but it is not free: call it after large deletions, not routinely.
+func (m *KVMap[K, V]) TrimDirty() {
+	m.lockWrite()
+	defer m.mu.Unlock()
+
+	if m.dirty != nil {
+		dirty := make(map[K]*entry[V], countLive(m.dirty))
+		for k, e := range m.dirty {
+			if !e.tryExpungeLocked() {
+				dirty[k] = e
+			}
+		}
+
+		m.dirty = dirty
+
+		return
+	}
+
+	read := m.loadReadOnly()
+	if len(read.m) == 0 {
+		return
+	}
+
+	trimmed := make(map[K]*entry[V], countLive(read.m))
+	for k, e := range read.m {
+		if !e.tryExpungeLocked() {
+			trimmed[k] = e
+		}
+	}
+
+	m.read.Store(&kvreadOnly[K, V]{m: trimmed})
+}
+
+// Promote moves the pending writes of the dirty map into the read-only snapshot right
+// away, instead of waiting for enough lookups to miss it.
+//
+// Lookups of the promoted keys then take the lock-free path from the start. Call it
+// at a convenient point of a known access pattern, such as after a bulk load and
+// before a read-heavy phase; the promotion itself is cheap, but the next write of a
+// new key copies the snapshot into a fresh dirty map, so promoting in the middle of
+// a stream of inserts only adds work. Promote does nothing if there are no pending
+// writes, and calls OnPromote like any other promotion.
+func (m *KVMap[K, V]) Promote() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.loadReadOnly().amended && !m.small {
+		m.promoteLocked()
+	}
+}
+
+// RangeValues calls f sequentially for each key and a copy of its value. If f
+// returns false, the iteration stops.
+//
+// For KVMap[K,V]: f receives (key K, value V).
+//
+// RangeValues behaves like Range, except that each stored pointer is dereferenced
+// and f gets a copy of the value instead of the pointer itself. Modifying that copy
+// has no effect on the map, which makes RangeValues the safer choice for read-only
+// passes. The copy is shallow: if V contains pointers, slices or maps, what they
+// refer to is still shared with the stored value.
+func (m *KVMap[K, V]) RangeValues(f func(key K, value V) bool) {
+	m.Range(func(key K, value *V) bool {
+		return f(key, *value)
+	})
+}
+
+// RangeSafe calls f sequentially for each key and a getter for its value. If f
+// returns false, the iteration stops.
+//
+// For KVMap[K,V]: f receives (key K, get func() V).
+//
+// RangeSafe sits between Range and RangeValues. Like RangeValues, it never hands
+// out the stored pointer: each call to get returns a new copy of the value, so
+// nothing f keeps can alias the map's contents. Like Range, it copies nothing for
+// entries whose value f never asks for, which keeps passes that filter on the key
+// cheap when V is large. The getter returns the value the entry held when Range
+// visited it, and may be called after f returns. The copy is shallow, as in
+// RangeValues.
+func (m *KVMap[K, V]) RangeSafe(f func(key K, get func() V) bool) {
+	m.Range(func(key K, value *V) bool {
+		return f(key, func() V { return *value })
+	})
+}
+
+// Walk calls f for each key and value present in the map, and lets f modify the
+// pointed-to value in place.
+//
+// Everywhere else, values reached through the map are treated as immutable, and
+// updates are made by storing a new pointer. Walk is for batch edits where copying
+// every value would be too costly, and it shifts the responsibility for safety to
+// the caller: the map does nothing to synchronize access to *V. Writing through the
+// pointer is safe only if no other goroutine can access the same value at the same
+// time, for instance during a single-threaded setup or maintenance phase, or if V
+// synchronizes itself, with atomic fields or a mutex of its own. Otherwise use
+// CompareAndSwap with a modified copy. Walk visits entries like Range does.
+func (m *KVMap[K, V]) Walk(f func(key K, value *V)) {
+	m.Range(func(key K, value *V) bool {
+		f(key, value)
+		return true
+	})
+}
+
+// RangeSample is like Range, but stops after visiting n live entries. If f returns
+// false, the iteration stops earlier.
+//
+// The entries visited are simply the first n that Range reaches, so they are not a
+// uniformly random sample, although the unspecified order of Range makes them vary
+// from one map to another. A non-positive n visits nothing.
+func (m *KVMap[K, V]) RangeSample(n int, f func(key K, value *V) bool) {
+	if n <= 0 {
+		return
+	}
+
+	m.Range(func(key K, value *V) bool {
+		n--
+		return f(key, value) && n > 0
+	})
+}
+
+// RangeErr calls f sequentially for each key and value present in the map, and
+// stops at the first call that returns a non-nil error, which it returns. If every
+// call returns nil, RangeErr returns nil. It otherwise behaves like Range.
+func (m *KVMap[K, V]) RangeErr(f func(key K, value *V) error) (err error) {
+	m.Range(func(key K, value *V) bool {
+		err = f(key, value)
+		return err == nil
+	})
+
+	return err
+}
+
+// RangeAndDelete removes the live entries of the map one by one, calling f with each
+// entry it removed. If f returns false, the iteration stops; the entry passed to
+// that call has already been removed.
+//
+// Each entry is removed with CompareAndDelete against the value Range visited. If
+// another goroutine replaced or deleted the value in the meantime, the entry is left
+// in place and f is not called for it, so every value is handed to f at most once
+// and no update made after it was visited is lost. This gives queue-drain semantics
+// without a separate Delete per key. Keys inserted during the pass may or may not be
+// visited, as with Range.
+func (m *KVMap[K, V]) RangeAndDelete(f func(key K, value *V) bool) {
+	m.Range(func(key K, value *V) bool {
+		if !m.CompareAndDelete(key, value) {
+			return true
+		}
+
+		return f(key, value)
+	})
+}
+
+// DrainChan removes the live entries of the map and streams them on the returned
+// channel, which is closed once the pass is over or ctx is done.
+//
+// For KVMap[K,V]: the channel carries KV[K,V] pairs holding copies of the values,
+// and has a buffer of buf entries.
+//
+// A goroutine started by DrainChan walks the map with RangeAndDelete and sends each
+// removed entry, so it has the same guarantees: each value is sent at most once, and
+// keys inserted during the pass may or may not be drained. A consumer that stops
+// receiving early must cancel ctx, or the goroutine blocks forever. On cancellation,
+// the entry the goroutine was trying to send is put back with LoadOrStore, unless
+// the key was written in the meantime; entries already sitting in the channel's
+// buffer have left the map, so a consumer that must not lose them should keep
+// receiving until the channel is closed.
+func (m *KVMap[K, V]) DrainChan(ctx context.Context, buf int) <-chan KV[K, V] {
+	if buf < 0 {
+		buf = 0
+	}
+
+	ch := make(chan KV[K, V], buf)
+
+	go func() {
+		defer close(ch)
+
+		m.RangeAndDelete(func(key K, value *V) bool {
+			select {
+			case ch <- KV[K, V]{Key: key, Value: *value}:
+				return true
+			case <-ctx.Done():
+				m.LoadOrStore(key, value)
+				return false
+			}
+		})
+	}()
+
+	return ch
+}
+
+// RangeCollectDeletes calls f for each key and value present in the map, collecting
+// the entries for which f returns true, and deletes them once the iteration is over.
+// It returns the number of entries deleted.
+//
+// The map is not modified while f runs, so the decisions f makes are not affected by
+// earlier deletions of the same pass. Each collected entry is then deleted with
+// CompareAndDelete against the value f saw: an entry whose value was replaced in the
+// meantime is left in place and not counted, so a newer value is never deleted on
+// the strength of a decision about an older one. Unlike RangeAndDelete, the pass
+// cannot be stopped early, and the collected keys are buffered in memory.
+func (m *KVMap[K, V]) RangeCollectDeletes(f func(key K, value *V) (deleteThis bool)) (deleted int) {
+	var doomed []KV[K, *V]
+	m.Range(func(key K, value *V) bool {
+		if f(key, value) {
+			doomed = append(doomed, KV[K, *V]{Key: key, Value: value})
+		}
+
+		return true
+	})
+
+	for _, e := range doomed {
+		if m.CompareAndDelete(e.Key, e.Value) {
+			deleted++
+		}
+	}
+
+	return deleted
+}
+
+// RangeStable is like Range, but visits the keys in a deterministic order: sorted by
+// the string keyStr returns for each of them.
+//
+// For KVMap[K,V]: (keyStr func(K) string, f func(key K, value *V) bool).
+//
+// It is meant for golden-file tests and other output that must come out the same on
+// every run, for key types that have no natural order. The live entries are
+// collected with Range first and f is called afterwards, so f may modify the map
+// and changes made during the pass are not visited. keyStr should be injective;
+// keys that map to the same string are visited in an unspecified order. RangeStable
+// allocates and sorts a copy of the whole map, so keep it out of hot paths.
+func (m *KVMap[K, V]) RangeStable(keyStr func(K) string, f func(key K, value *V) bool) {
+	type item struct {
+		str   string
+		key   K
+		value *V
+	}
+
+	var items []item
+	m.Range(func(key K, value *V) bool {
+		items = append(items, item{str: keyStr(key), key: key, value: value})
+		return true
+	})
+
+	slices.SortFunc(items, func(a, b item) int {
+		return strings.Compare(a.str, b.str)
+	})
+
+	for _, it := range items {
+		if !f(it.key, it.value) {
+			return
+		}
+	}
+}
+
+// Cap returns a rough estimate of the number of slots held by the map's internal
+// storage: the length of the read-only map plus the length of the dirty map.
+//
+// The estimate is meant for sizing decisions, such as whether a TrimDirty is worth
+// it, and should not be read as a count of entries. It includes deleted entries that
+// have not been cleaned up yet, and entries that are present in both internal maps
+// are counted twice. Deleting keys that are in the read-only map therefore does not
+// make Cap shrink; it only drops once the deleted entries are discarded, for instance
+// by TrimDirty or Clear. Keys only in the dirty map are removed from it outright.
+func (m *KVMap[K, V]) Cap() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.loadReadOnly().m) + len(m.dirty)
+}
+
+// EstimateBytes returns a rough estimate of the memory held by the map, in bytes.
+//
+// The estimate combines the slots counted by Cap, each holding a key and an entry
+// pointer plus the hash table's own overhead, with one entry and one V allocation
+// per entry counted by ApproxLen, all sized with unsafe.Sizeof. It is meant for
+// capacity planning and trend monitoring, not for accounting: it ignores memory
+// that keys and values refer to (strings, slices, maps, pointers), allocator size
+// classes and the fixed size of the KVMap itself, and the bytes per slot charged for
+// the hash table are an approximation of the runtime's layout.
+func (m *KVMap[K, V]) EstimateBytes() int64 {
+	// The table overhead of 5/4 accounts for hash tables never being completely
+	// full; the control byte of each slot is counted in slot.
+	const tableOverheadNum, tableOverheadDen = 5, 4
+
+	var (
+		key   K
+		value V
+	)
+
+	slot := int64(unsafe.Sizeof(key)) + int64(unsafe.Sizeof((*entry[V])(nil))) + 1
+	perEntry := int64(unsafe.Sizeof(entry[V]{})) + int64(unsafe.Sizeof(value))
+
+	return int64(m.Cap())*slot*tableOverheadNum/tableOverheadDen + m.ApproxLen()*perEntry
+}
+
+// DrainInto moves every live entry of the map into dst and leaves the map empty.
+//
+// For KVMap[K,V]: dst is a map[K]*V, which must not be nil. Entries are added to dst,
+// replacing values already stored there under the same keys; other contents of dst
+// are left alone, so callers reusing dst between drains should clear it first.
+//
+// The whole operation happens under the map's lock, and in contrast to Clear no
+// update can slip through it: each entry is detached from the map at the same
+// instant its value is taken, so a concurrent CompareAndSwap or Store on that key
+// either happens before the drain (and its value is moved to dst) or fails and
+// retries against the emptied map. This makes DrainInto suitable for flushing
+// counters that other goroutines keep updating, without losing or double-counting
+// increments. While the drain is in progress, concurrent loads of the drained keys
+// may already report them as absent.
+func (m *KVMap[K, V]) DrainInto(dst map[K]*V) {
+	m.lockWrite()
+	defer m.mu.Unlock()
+
+	for k, e := range m.entriesLocked() {
+		if v, ok := e.detachLocked(); ok {
+			dst[k] = v
+		}
+	}
+
+	m.replaceLocked(nil)
+}
+
+// SwapKeys exchanges the values stored under two keys.
+//
+// For KVMap[K,V]: (a K, b K) -> (ok bool).
+//
+// If either key is absent, the map is left unchanged and SwapKeys returns false.
+// Swapping a key with itself succeeds without changing anything.
+//
+// SwapKeys holds the map's lock, so operations that take the lock never observe a
+// state where only one of the two values has moved. Each value is replaced with a
+// compare-and-swap against the value read at the start; if a lock-free update to one
+// of the keys interferes, the partial exchange is rolled back and retried. Lock-free
+// loads of the two keys may still see the exchange half done for a brief moment.
+func (m *KVMap[K, V]) SwapKeys(a, b K) (ok bool) {
+	m.lockWrite()
+	defer m.mu.Unlock()
+
+	for {
+		ea, ok := m.entryLocked(a)
+		if !ok {
+			return false
+		}
+
+		eb, ok := m.entryLocked(b)
+		if !ok {
+			return false
+		}
+
+		va, ok := ea.load()
+		if !ok {
+			return false
+		}
+
+		vb, ok := eb.load()
+		if !ok {
+			return false
+		}
+
+		if a == b {
+			return true
+		}
+
+		if !ea.tryCompareAndSwap(va, vb) {
+			continue
+		}
+
+		if eb.tryCompareAndSwap(vb, va) {
+			return true
+		}
+
+		ea.tryCompareAndSwap(vb, va)
+	}
+}
+
+// ReplaceAll discards the current contents of the map and replaces them with
+// entries.
+//
+// For KVMap[K,V]: 'entries' is a map[K]*V; nil values in it are skipped. The map
+// does not retain entries itself, so the caller may reuse it afterwards, but the
+// value pointers are stored as is.
+//
+// The new contents are built on the side and installed with a single atomic store
+// of the read-only snapshot, under the map's lock. A Load that starts after ReplaceAll
+// returns sees only the new entries, and one that started before sees only the old
+// ones, so readers never observe a mix of the two tables. The new entries are
+// readable without locking right away. As with Clear, an update of an old key that
+// races with ReplaceAll may be lost.
+func (m *KVMap[K, V]) ReplaceAll(entries map[K]*V) {
+	fresh := newEntries(entries)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.replaceLocked(fresh)
+}
+
+// Rebuild replaces the contents of the map with the result of f, applied to its
+// current contents, as one atomic step.
+//
+// For KVMap[K,V]: f receives the live entries as a map[K]*V that it may modify and
+// return, or it may return a new map. Nil values in the result are skipped, and the
+// value pointers are stored as is.
+//
+// Rebuild holds the map's lock throughout, so f must not call any method of the map.
+// Writers that take the lock wait for f to return and then apply to the rebuilt
+// contents. The entries passed to f stay in place while it runs, so lock-free Loads
+// keep seeing the old contents until the result of f is installed with a single
+// atomic store of the read-only snapshot, as in ReplaceAll, and never observe a
+// missing key or a mix of the two tables. As with ReplaceAll, a lock-free update of
+// an existing key that races with Rebuild may be lost. It suits rare global
+// transforms such as deduplicating, re-keying or pruning, at the cost of blocking
+// every writer and every lookup that misses the read-only snapshot until f returns.
+// If f panics, the map is left unchanged.
+func (m *KVMap[K, V]) Rebuild(f func(current map[K]*V) map[K]*V) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries := m.entriesLocked()
+	current := make(map[K]*V, len(entries))
+	for k, e := range entries {
+		if v, ok := e.load(); ok {
+			current[k] = v
+		}
+	}
+
+	m.replaceLocked(newEntries(f(current)))
+}
+
+// Fork returns an independent copy of the map. Writes to the copy never affect m,
+// and writes to m never affect the copy.
+//
+// Fork is O(1): it promotes any pending writes of m and then shares the read-only
+// snapshot between the two maps, copy-on-write. Lookups on both stay lock-free, and
+// each map makes a copy of the entries of its own, in O(n), on its first write: while
+// the snapshot is shared, even updates of existing keys, which otherwise never lock,
+// take the lock to make that copy. A fork that is only read, or discarded before
+// either map is written, never costs a copy. Lock-free updates of m already in
+// progress when Fork is called finish before it returns and are reflected in both
+// maps; to that end, those updates count themselves on a counter of the map while
+// they run, and Fork waits for it to drop to zero.
+//
+// The copy holds the same value pointers as m, so the values themselves are shared
+// and must be treated as immutable, as usual. OnPromote and CountPaths are carried
+// over; the PathStats counters start from zero. A small-mode map has no snapshot to
+// share, so its Fork copies the entries, which are few by design.
+func (m *KVMap[K, V]) Fork() *KVMap[K, V] {
+	f := &KVMap[K, V]{OnPromote: m.OnPromote, CountPaths: m.CountPaths, small: m.small}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.small {
+		f.replaceLocked(copyEntries(m.dirty))
+		return f
+	}
+
+	read := m.loadReadOnly()
+	if read.amended {
+		read = m.promoteLocked()
+	}
+
+	if !read.shared {
+		read.shared = true
+		m.read.Store(&read)
+
+		// Updates that loaded the snapshot before it was marked shared may still be
+		// writing to its entries; later ones see the mark and wait for the lock.
+		for m.writers.Load() != 0 {
+			runtime.Gosched()
+		}
+	}
+
+	f.read.Store(&kvreadOnly[K, V]{m: read.m, shared: true})
+	f.size.Store(m.size.Load())
+
+	return f
+}
+
+// Freeze takes a snapshot of the map and returns a lookup function backed by it.
+//
+// For KVMap[K,V]: the returned function has the signature of Load.
+//
+// The snapshot is a plain Go map that is never modified after Freeze returns, so the
+// lookup function never locks, is safe for any number of concurrent callers, and
+// keeps returning the same answers no matter what is written to m afterwards. It
+// suits hot-reload patterns: writers update m, then publish a new view by calling
+// Freeze again. The snapshot is collected with Range, so its consistency notes
+// apply to writes made while Freeze runs, and it costs O(n) time and memory.
+func (m *KVMap[K, V]) Freeze() func(key K) (value *V, ok bool) {
+	frozen := m.snapshot()
+
+	return func(key K) (*V, bool) {
+		v, ok := frozen[key]
+		return v, ok
+	}
+}
+
+// KeysAppend appends the keys of all live entries to dst, in unspecified order, and
+// returns the extended slice.
+//
+// Passing a previous result truncated to zero length, as in keys = m.KeysAppend(keys[:0]),
+// reuses its backing array, so a polling loop allocates nothing once the buffer has
+// grown to the size of the map. The keys are collected with Range, so its
+// consistency notes apply.
+func (m *KVMap[K, V]) KeysAppend(dst []K) []K {
+	m.Range(func(key K, _ *V) bool {
+		dst = append(dst, key)
+		return true
+	})
+
+	return dst
+}
+
+// EntriesInto clears dst and fills it with the live entries of the map.
+//
+// For KVMap[K,V]: the values put into dst are the stored pointers, not copies.
+//
+// Clearing keeps the storage dst has already allocated, so reusing the same map
+// across calls avoids allocating a new one every time. The entries are collected
+// with Range, so its consistency notes apply.
+func (m *KVMap[K, V]) EntriesInto(dst map[K]*V) {
+	clear(dst)
+
+	m.Range(func(key K, value *V) bool {
+		dst[key] = value
+		return true
+	})
+}
+
+// CompareAndSwapAll applies a set of compare-and-swap updates as a unit: either every
+// key's current value matches its Old pointer and all of the New values are stored,
+// or nothing changes.
+//
+// For KVMap[K,V]: 'updates' maps each key to its {Old, New} pair. A nil Old expects
+// the key to be absent, and a nil New deletes the key. The comparison is pointer
+// equality, as in CompareAndSwap.
+//
+// The check and the updates happen under the map's lock, so operations that take the
+// lock never see a partially applied batch. Existing keys can still be updated
+// without the lock, so each update is applied with its own compare-and-swap: if a
+// lock-free writer changes one of the keys after the check, the updates already
+// applied are rolled back and CompareAndSwapAll returns false, as if the check had
+// failed. Lock-free readers may briefly observe the batch half applied.
+func (m *KVMap[K, V]) CompareAndSwapAll(updates map[K]struct{ Old, New *V }) (swapped bool) {
+	m.lockWrite()
+	defer m.mu.Unlock()
+
+	for k, u := range updates {
+		var cur *V
+		if e, ok := m.entryLocked(k); ok {
+			cur, _ = e.load()
+		}
+
+		if cur != u.Old {
+			return false
+		}
+	}
+
+	applied := make([]K, 0, len(updates))
+	for k, u := range updates {
+		if !m.replaceValueLocked(k, u.Old, u.New) {
+			for i := len(applied) - 1; i >= 0; i-- {
+				ak := applied[i]
+				au := updates[ak]
+				m.replaceValueLocked(ak, au.New, au.Old)
+			}
+
+			return false
+		}
+
+		applied = append(applied, k)
+	}
+
+	return true
+}
+
+// RangeChunks calls f with the live entries of the map grouped into chunks of up to
+// size entries. If f returns false, the iteration stops.
+//
+// For KVMap[K,V]: each chunk is a []KV[K,V] holding copies of the values, as in
+// RangeValues.
+//
+// Entries are collected with Range, so its consistency notes apply. Every chunk but
+// the last holds exactly size entries, and an empty map produces no call at all.
+// Each chunk is a new slice that f may keep. A size below 1 is treated as 1.
+func (m *KVMap[K, V]) RangeChunks(size int, f func(chunk []KV[K, V]) bool) {
+	if size < 1 {
+		size = 1
+	}
+
+	chunk := make([]KV[K, V], 0, size)
+	stopped := false
+
+	m.Range(func(key K, value *V) bool {
+		chunk = append(chunk, KV[K, V]{Key: key, Value: *value})
+		if len(chunk) < size {
+			return true
+		}
+
+		if !f(chunk) {
+			stopped = true
+			return false
+		}
+
+		chunk = make([]KV[K, V], 0, size)
+
+		return true
+	})
+
+	if !stopped && len(chunk) > 0 {
+		f(chunk)
+	}
+}
+
+// LoadOrStoreMany calls LoadOrStore for every key in entries and returns the
+// resulting values.
+//
+// For KVMap[K,V]: 'entries' maps each key to the value to store if the key is
+// absent. actual maps every key of entries to the value the map holds for it after
+// the call: the existing one if the key was present, the one from entries
+// otherwise. anyStored reports whether at least one key was inserted. Unlike
+// ReplaceAll, existing values are never overwritten. As with LoadOrStore, a nil
+// value is never stored; its key maps to the existing value, or to nil if there is
+// none.
+//
+// All keys are processed under a single acquisition of the map's lock, so other
+// locked operations see either none or all of the inserts. Lock-free readers may
+// observe them one at a time, and a key deleted concurrently through the read-only
+// snapshot may still be stored by another goroutine in the middle of the batch.
+func (m *KVMap[K, V]) LoadOrStoreMany(entries map[K]*V) (actual map[K]*V, anyStored bool) {
+	actual = make(map[K]*V, len(entries))
+
+	m.lockWrite()
+	defer m.mu.Unlock()
+
+	for k, v := range entries {
+		a, loaded := m.loadOrStoreLocked(k, v)
+		actual[k] = a
+		if !loaded && v != nil {
+			anyStored = true
+		}
+	}
+
+	return actual, anyStored
+}
+
+// countPath increments c if CountPaths is set.
+func (m *KVMap[K, V]) countPath(c *atomic.Uint64) {
+	if m.CountPaths {
+		c.Add(1)
+	}
+}
+
 func (m *KVMap[K, V]) missLocked() {
+	if m.small {
+		return
+	}
+
 	m.misses++
 	if m.misses < len(m.dirty) {
 		return
 	}
 
-	m.read.Store(&kvreadOnly[K, V]{m: m.dirty})
+	m.promoteLocked()
+}
+
+// promoteLocked installs the dirty map as the new read-only map and returns it.
+// m.mu must be held and the read-only map must be amended.
+func (m *KVMap[K, V]) promoteLocked() kvreadOnly[K, V] {
+	read := &kvreadOnly[K, V]{m: m.dirty}
+	m.read.Store(read)
+	m.promotedLocked(len(m.dirty))
 
 	m.dirty = nil
 	m.misses = 0
+
+	return *read
+}
+
+// promotedLocked reports a promotion of n dirty entries to OnPromote. m.mu must be
+// held.
+func (m *KVMap[K, V]) promotedLocked(n int) {
+	if m.OnPromote != nil {
+		m.OnPromote(n)
+	}
 }
 
 func (m *KVMap[K, V]) dirtyLocked() {
@@ -454,3 +1962,221 @@ func (m *KVMap[K, V]) dirtyLocked() {
 		}
 	}
 }
+
+// sweepLocked drops the deleted entries of a small-mode map once the dirty map holds
+// twice as many entries as there are live ones. Deleting a key with LoadAndDelete
+// removes its entry, but CompareAndDelete and storing nil only mark it deleted, and
+// without a promotion to clean those up they would pile up as keys come and go. In
+// the default mode it does nothing. m.mu must be held.
+func (m *KVMap[K, V]) sweepLocked() {
+	if !m.small || len(m.dirty) < 2*int(m.size.Load())+8 {
+		return
+	}
+
+	for k, e := range m.dirty {
+		if e.tryExpungeLocked() {
+			delete(m.dirty, k)
+		}
+	}
+}
+
+// entryLocked returns the entry for key from the read-only map or, if the read-only
+// map is amended, from the dirty map. It does not record a miss. m.mu must be held.
+func (m *KVMap[K, V]) entryLocked(key K) (e *entry[V], ok bool) {
+	read := m.loadReadOnly()
+	e, ok = read.m[key]
+	if !ok && read.amended {
+		e, ok = m.dirty[key]
+	}
+
+	return e, ok
+}
+
+// keysLocked returns the keys of all live entries. m.mu must be held.
+func (m *KVMap[K, V]) keysLocked() []K {
+	entries := m.entriesLocked()
+
+	keys := make([]K, 0, len(entries))
+	for k, e := range entries {
+		if _, ok := e.load(); ok {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys
+}
+
+// entriesLocked returns the map holding every entry that may be live: the dirty
+// map if the read-only map is amended, otherwise the read-only map itself. The
+// result must not be modified. m.mu must be held.
+func (m *KVMap[K, V]) entriesLocked() map[K]*entry[V] {
+	read := m.loadReadOnly()
+	if read.amended {
+		return m.dirty
+	}
+
+	return read.m
+}
+
+// deleteLocked is the locked equivalent of LoadAndDelete. m.mu must be held.
+func (m *KVMap[K, V]) deleteLocked(key K) (value *V, loaded bool) {
+	read := m.loadReadOnly()
+	e, ok := read.m[key]
+	if !ok && read.amended {
+		e, ok = m.dirty[key]
+
+		delete(m.dirty, key)
+	}
+
+	if ok {
+		if value, loaded = e.delete(); loaded {
+			m.trackLen(value, nil)
+		}
+		return value, loaded
+	}
+
+	return nil, false
+}
+
+// snapshot copies the live entries of the map into a plain map using Range.
+func (m *KVMap[K, V]) snapshot() map[K]*V {
+	entries := make(map[K]*V, len(m.loadReadOnly().m))
+	m.Range(func(key K, value *V) bool {
+		entries[key] = value
+		return true
+	})
+
+	return entries
+}
+
+// lenLocked returns the number of live entries. m.mu must be held.
+func (m *KVMap[K, V]) lenLocked() int {
+	return countLive(m.entriesLocked())
+}
+
+// countLive returns the number of entries in entries that hold a value.
+func countLive[K comparable, V any](entries map[K]*entry[V]) int {
+	n := 0
+	for _, e := range entries {
+		if _, ok := e.load(); ok {
+			n++
+		}
+	}
+
+	return n
+}
+
+// newEntries wraps the non-nil values of values in new entries.
+func newEntries[K comparable, V any](values map[K]*V) map[K]*entry[V] {
+	entries := make(map[K]*entry[V], len(values))
+	for k, v := range values {
+		if v != nil {
+			entries[k] = newEntry(v)
+		}
+	}
+
+	return entries
+}
+
+// beginWrite announces a lock-free update of an entry of the read-only map, and
+// returns the snapshot to look the entry up in with writable. Every call must be
+// followed by endWrite once the update is done, and before taking m.mu: Fork holds
+// m.mu while it waits for the updates in progress to end.
+func (m *KVMap[K, V]) beginWrite() kvreadOnly[K, V] {
+	m.writers.Add(1)
+
+	return m.loadReadOnly()
+}
+
+// endWrite ends an update started with beginWrite.
+func (m *KVMap[K, V]) endWrite() {
+	m.writers.Add(-1)
+}
+
+// lockWrite locks m.mu for an operation that may modify entries, first giving the
+// map entries of its own if its read-only snapshot is shared with a fork.
+func (m *KVMap[K, V]) lockWrite() {
+	m.mu.Lock()
+
+	read := m.loadReadOnly()
+	if read.shared {
+		m.read.Store(&kvreadOnly[K, V]{m: copyEntries(read.m)})
+		m.misses = 0
+	}
+}
+
+// copyEntries returns new entries holding the live values of entries.
+func copyEntries[K comparable, V any](entries map[K]*entry[V]) map[K]*entry[V] {
+	fresh := make(map[K]*entry[V], len(entries))
+	for k, e := range entries {
+		if v, ok := e.load(); ok {
+			fresh[k] = newEntry(v)
+		}
+	}
+
+	return fresh
+}
+
+// replaceLocked installs entries as the new read-only map, dropping the dirty map
+// and resetting the bookkeeping. A nil entries empties the map. m.mu must be held.
+func (m *KVMap[K, V]) replaceLocked(entries map[K]*entry[V]) {
+	if m.small {
+		if entries == nil {
+			entries = make(map[K]*entry[V])
+		}
+
+		m.read.Store(&kvreadOnly[K, V]{amended: true})
+		m.dirty = entries
+	} else {
+		m.read.Store(&kvreadOnly[K, V]{m: entries})
+		m.dirty = nil
+	}
+
+	m.misses = 0
+	m.size.Store(int64(len(entries)))
+	m.grown.broadcast()
+}
+
+// compareAndSwapEntry is tryCompareAndSwap on e, accounting for the deletion when
+// new is nil.
+func (m *KVMap[K, V]) compareAndSwapEntry(e *entry[V], old, new *V) bool {
+	if !e.tryCompareAndSwap(old, new) {
+		return false
+	}
+
+	m.trackLen(old, new)
+
+	return true
+}
+
+// trackLen updates the approximate length after an entry went from prev to new.
+// Only transitions between absent and present change it.
+func (m *KVMap[K, V]) trackLen(prev, new *V) {
+	switch {
+	case prev == nil && new != nil:
+		m.size.Add(1)
+		m.grown.broadcast()
+	case prev != nil && new == nil:
+		m.size.Add(-1)
+	}
+}
+
+// replaceValueLocked sets key to new if its current value is old, where a nil old
+// stands for an absent key and a nil new deletes the key. m.mu must be held.
+func (m *KVMap[K, V]) replaceValueLocked(key K, old, new *V) bool {
+	if old == new {
+		return true
+	}
+
+	if old == nil {
+		_, loaded := m.loadOrStoreLocked(key, new)
+		return !loaded
+	}
+
+	e, ok := m.entryLocked(key)
+	if !ok {
+		return false
+	}
+
+	return m.compareAndSwapEntry(e, old, new)
+}
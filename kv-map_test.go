@@ -0,0 +1,2357 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRebuild(t *testing.T) {
+	var m KVMap[int, int]
+	for i := 0; i < 100; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+
+	// Promote the entries so that the readers below take the lock-free path.
+	for i := 0; i < 100; i++ {
+		m.Load(i)
+	}
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				for i := 0; i < 100; i += 7 {
+					if _, ok := m.Load(i); !ok {
+						t.Errorf("Load(%d) missing during Rebuild", i)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for r := 0; r < 50; r++ {
+		m.Rebuild(func(current map[int]*int) map[int]*int {
+			if len(current) != 100 {
+				t.Errorf("Rebuild got %d entries, want 100", len(current))
+			}
+			for k, v := range current {
+				n := *v + 1
+				current[k] = &n
+			}
+			return current
+		})
+	}
+
+	stop.Store(true)
+	wg.Wait()
+
+	for i := 0; i < 100; i++ {
+		if v, ok := m.Load(i); !ok || *v != i+50 {
+			t.Fatalf("Load(%d) = %v, %v; want %d", i, v, ok, i+50)
+		}
+	}
+}
+
+func TestRebuildRekey(t *testing.T) {
+	var m KVMap[int, int]
+	for i := 0; i < 100; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+
+	m.Rebuild(func(current map[int]*int) map[int]*int {
+		next := make(map[int]*int)
+		for k, v := range current {
+			if k%2 == 0 {
+				next[k+1000] = v
+			}
+		}
+		return next
+	})
+
+	if n := m.Len(); n != 50 {
+		t.Fatalf("Len() = %d after Rebuild, want 50", n)
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := m.Load(i); ok {
+			t.Fatalf("old key %d survived the rebuild", i)
+		}
+		v, ok := m.Load(i + 1000)
+		if want := i%2 == 0; ok != want || (ok && *v != i) {
+			t.Fatalf("Load(%d) = %v, %v; want present = %v", i+1000, v, ok, want)
+		}
+	}
+}
+
+func TestRebuildPanic(t *testing.T) {
+	var m KVMap[string, int]
+	one := 1
+	m.Store("a", &one)
+
+	func() {
+		defer func() { _ = recover() }()
+		m.Rebuild(func(current map[string]*int) map[string]*int {
+			delete(current, "a")
+			panic("boom")
+		})
+	}()
+
+	if v, ok := m.Load("a"); !ok || *v != 1 {
+		t.Fatalf("Load(a) = %v, %v after a panicking Rebuild; want 1", v, ok)
+	}
+
+	two := 2
+	m.Store("b", &two)
+	if n := m.Len(); n != 2 {
+		t.Fatalf("Len() = %d, want 2", n)
+	}
+}
+
+func TestLoadOrComputeSingleFlightLeaderCanceled(t *testing.T) {
+	var m KVMap[string, int]
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := m.LoadOrComputeSingleFlight(leaderCtx, "k", func(ctx context.Context) (*int, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+		leaderErr <- err
+	}()
+	<-started
+
+	waiterDone := make(chan struct{})
+	var got *int
+	var err error
+	go func() {
+		defer close(waiterDone)
+		got, err = m.LoadOrComputeSingleFlight(context.Background(), "k", func(context.Context) (*int, error) {
+			v := 42
+			return &v, nil
+		})
+	}()
+
+	// Give the waiter time to join the leader's flight before it is canceled.
+	for i := 0; i < 100; i++ {
+		runtime.Gosched()
+	}
+	cancel()
+
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("leader: err = %v, want context.Canceled", err)
+	}
+
+	<-waiterDone
+	if err != nil || got == nil || *got != 42 {
+		t.Fatalf("waiter: got %v, %v; want 42, nil", got, err)
+	}
+}
+
+func TestLoadOrComputeSingleFlightSharesErrors(t *testing.T) {
+	var m KVMap[string, int]
+	boom := errors.New("boom")
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	compute := func(context.Context) (*int, error) {
+		calls.Add(1)
+		<-release
+		return nil, boom
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = m.LoadOrComputeSingleFlight(context.Background(), "k", compute)
+		}()
+	}
+
+	for calls.Load() == 0 {
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+
+	for i, err := range errs {
+		if !errors.Is(err, boom) {
+			t.Errorf("caller %d: err = %v, want boom", i, err)
+		}
+	}
+	if _, ok := m.Load("k"); ok {
+		t.Fatal("a failed computation was stored")
+	}
+}
+
+func TestLoadOrStoreBounded(t *testing.T) {
+	var m KVMap[int, int]
+	const max = 50
+
+	var stored atomic.Int32
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				v := w*100 + i
+				if _, loaded, full := m.LoadOrStoreBounded(v, &v, max); !loaded && !full {
+					stored.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := stored.Load(); n != max {
+		t.Fatalf("stored %d keys, want %d", n, max)
+	}
+	if n := m.Len(); n != max {
+		t.Fatalf("Len() = %d, want %d", n, max)
+	}
+
+	var first int
+	m.Range(func(k int, _ *int) bool {
+		first = k
+		return false
+	})
+	if v, loaded, full := m.LoadOrStoreBounded(first, nil, max); !loaded || full || *v != first {
+		t.Fatalf("LoadOrStoreBounded of a present key = %v, %v, %v", v, loaded, full)
+	}
+
+	m.Delete(first)
+	v := -1
+	if _, loaded, full := m.LoadOrStoreBounded(v, &v, max); loaded || full {
+		t.Fatalf("LoadOrStoreBounded after Delete = %v, %v; want stored", loaded, full)
+	}
+	if _, _, full := m.LoadOrStoreBounded(-2, &v, max); !full {
+		t.Fatal("LoadOrStoreBounded on a full map stored a key")
+	}
+}
+
+// TestLoadOrStoreBoundedDriftedCounter checks that the limit holds when the counter
+// behind ApproxLen disagrees with the actual number of entries.
+func TestLoadOrStoreBoundedDriftedCounter(t *testing.T) {
+	const max = 10
+
+	var m KVMap[int, int]
+	for i := 0; i < max; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+
+	m.size.Store(0)
+	v := -1
+	if _, _, full := m.LoadOrStoreBounded(-1, &v, max); !full {
+		t.Fatal("LoadOrStoreBounded stored a key into a full map whose counter drifted low")
+	}
+
+	m.Delete(0)
+	m.size.Store(2 * max)
+	if _, loaded, full := m.LoadOrStoreBounded(-1, &v, max); loaded || full {
+		t.Fatalf("LoadOrStoreBounded below the limit with a counter drifted high = %v, %v; want stored", loaded, full)
+	}
+	if n := m.Len(); n != max {
+		t.Fatalf("Len() = %d, want %d", n, max)
+	}
+}
+
+func TestRangeParallel(t *testing.T) {
+	var m KVMap[int, int]
+	const n = 1000
+	for i := 0; i < n; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+	m.Delete(0)
+
+	var mu sync.Mutex
+	seen := make(map[int]int)
+	m.RangeParallel(4, func(k int, v *int) {
+		if *v != k {
+			t.Errorf("f(%d, %d): value does not match its key", k, *v)
+		}
+		mu.Lock()
+		seen[k]++
+		mu.Unlock()
+	})
+
+	if len(seen) != n-1 {
+		t.Fatalf("visited %d keys, want %d", len(seen), n-1)
+	}
+	for k, c := range seen {
+		if c != 1 {
+			t.Errorf("key %d visited %d times", k, c)
+		}
+	}
+	if _, ok := seen[0]; ok {
+		t.Error("deleted key 0 visited")
+	}
+}
+
+func TestRangeParallelPanic(t *testing.T) {
+	var m KVMap[int, int]
+	for i := 0; i < 100; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+
+	var calls atomic.Int32
+	defer func() {
+		if r := recover(); r != "boom" {
+			t.Fatalf("recovered %v, want boom", r)
+		}
+		if n := calls.Load(); n != 100 {
+			t.Fatalf("f called %d times before the panic propagated, want 100", n)
+		}
+	}()
+
+	m.RangeParallel(4, func(k int, _ *int) {
+		calls.Add(1)
+		if k == 50 {
+			panic("boom")
+		}
+	})
+}
+
+func TestRename(t *testing.T) {
+	var m KVMap[string, int]
+	one, two := 1, 2
+	m.Store("old", &one)
+	m.Store("taken", &two)
+
+	if !m.Rename("old", "new") {
+		t.Fatal("Rename(old, new) = false")
+	}
+	if _, ok := m.Load("old"); ok {
+		t.Error("old still present after Rename")
+	}
+	if v, ok := m.Load("new"); !ok || v != &one {
+		t.Errorf("Load(new) = %v, %v; want the renamed value", v, ok)
+	}
+
+	if m.Rename("missing", "other") {
+		t.Error("Rename of an absent key = true")
+	}
+	if _, ok := m.Load("other"); ok {
+		t.Error("Rename of an absent key created its target")
+	}
+
+	if m.Rename("new", "taken") {
+		t.Error("Rename onto a present key = true")
+	}
+	if v, _ := m.Load("new"); v != &one {
+		t.Error("failed Rename changed the source")
+	}
+	if v, _ := m.Load("taken"); v != &two {
+		t.Error("failed Rename overwrote the target")
+	}
+
+	if m.Rename("new", "new") {
+		t.Error("Rename of a key to itself = true")
+	}
+}
+
+func TestRangeSnapshot(t *testing.T) {
+	var m KVMap[int, int]
+	for i := 0; i < 10; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+
+	deleted := -1
+	visited := make(map[int]bool)
+	m.RangeSnapshot(func(k int, _ *int) bool {
+		if deleted < 0 {
+			deleted = (k + 1) % 10
+			m.Delete(deleted)
+		}
+		visited[k] = true
+		n := k + 100
+		m.Store(n, &n)
+		return true
+	})
+
+	if len(visited) != 9 {
+		t.Errorf("visited %d keys, want 9", len(visited))
+	}
+	for i := 0; i < 10; i++ {
+		if visited[i] == (i == deleted) {
+			t.Errorf("key %d: visited = %v, deleted = %v", i, visited[i], i == deleted)
+		}
+	}
+	for k := range visited {
+		if k >= 100 {
+			t.Errorf("visited key %d inserted during iteration", k)
+		}
+	}
+}
+
+func TestTrimDirty(t *testing.T) {
+	var m KVMap[int, int]
+	for i := 0; i < 10000; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+	for i := 0; i < 10000; i++ {
+		if i%100 != 0 {
+			m.Delete(i)
+		}
+	}
+
+	m.TrimDirty()
+
+	if n := len(m.entriesLocked()); n != 100 {
+		t.Errorf("%d entries kept after TrimDirty, want 100", n)
+	}
+	for i := 0; i < 10000; i++ {
+		v, ok := m.Load(i)
+		if want := i%100 == 0; ok != want || (ok && *v != i) {
+			t.Fatalf("Load(%d) = %v, %v; want present = %v", i, v, ok, want)
+		}
+	}
+
+	// Trimming the promoted read-only map works the same way.
+	for i := 0; i < 10000; i += 100 {
+		m.Load(-1)
+	}
+	for i := 0; i < 50; i++ {
+		m.Delete(i * 100)
+	}
+	m.TrimDirty()
+	if n := m.Len(); n != 50 {
+		t.Fatalf("Len() = %d after the second TrimDirty, want 50", n)
+	}
+}
+
+func TestOnPromote(t *testing.T) {
+	var promotions []int
+	m := &KVMap[int, int]{OnPromote: func(n int) { promotions = append(promotions, n) }}
+
+	for i := 0; i < 3; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+
+	// Misses on keys that are only in the dirty map promote it once they reach its
+	// size.
+	for i := 0; i < 3; i++ {
+		m.Load(0)
+	}
+	if len(promotions) != 1 || promotions[0] != 3 {
+		t.Fatalf("promotions after misses = %v, want [3]", promotions)
+	}
+
+	// Range promotes a dirty map with pending entries.
+	four := 4
+	m.Store(4, &four)
+	m.Range(func(int, *int) bool { return true })
+	if len(promotions) != 2 || promotions[1] != 4 {
+		t.Fatalf("promotions after Range = %v, want [3 4]", promotions)
+	}
+
+	// Without pending writes there is nothing to promote.
+	m.Range(func(int, *int) bool { return true })
+	if len(promotions) != 2 {
+		t.Fatalf("promotions after a clean Range = %v, want 2 of them", promotions)
+	}
+}
+
+func TestLoadOrStoreDetailedCreatedOnce(t *testing.T) {
+	for round := 0; round < 200; round++ {
+		var m KVMap[string, int]
+		shared := round
+
+		const n = 16
+		var created atomic.Int32
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				// Every caller passes the same pointer, so only created tells them
+				// apart.
+				actual, loaded, c := m.LoadOrStoreDetailed("k", &shared)
+				if actual != &shared || loaded == c {
+					t.Errorf("LoadOrStoreDetailed = %p, %v, %v", actual, loaded, c)
+				}
+				if c {
+					created.Add(1)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		if c := created.Load(); c != 1 {
+			t.Fatalf("round %d: %d of %d racing calls reported created", round, c, n)
+		}
+	}
+}
+
+func TestLoadOrStoreDetailedNil(t *testing.T) {
+	var m KVMap[string, int]
+	if actual, loaded, created := m.LoadOrStoreDetailed("k", nil); actual != nil || loaded || created {
+		t.Fatalf("LoadOrStoreDetailed(k, nil) = %v, %v, %v", actual, loaded, created)
+	}
+}
+
+func TestRangeValuesCopies(t *testing.T) {
+	type point struct{ x, y int }
+
+	var m KVMap[string, point]
+	m.Store("p", &point{1, 2})
+
+	m.RangeValues(func(_ string, p point) bool {
+		p.x = 100
+		return true
+	})
+
+	if v, _ := m.Load("p"); v.x != 1 {
+		t.Fatalf("mutating the copy changed the stored value to %v", *v)
+	}
+}
+
+func TestLoadAndDeleteIf(t *testing.T) {
+	var m KVMap[string, int]
+	done, pending := 1, 0
+	m.Store("done", &done)
+	m.Store("pending", &pending)
+
+	isDone := func(v *int) bool { return *v == 1 }
+
+	if v, deleted := m.LoadAndDeleteIf("done", isDone); !deleted || v != &done {
+		t.Fatalf("LoadAndDeleteIf(done) = %v, %v; want the value, true", v, deleted)
+	}
+	if _, ok := m.Load("done"); ok {
+		t.Fatal("key survived a true predicate")
+	}
+
+	if v, deleted := m.LoadAndDeleteIf("pending", isDone); deleted || v != &pending {
+		t.Fatalf("LoadAndDeleteIf(pending) = %v, %v; want the value, false", v, deleted)
+	}
+	if _, ok := m.Load("pending"); !ok {
+		t.Fatal("key deleted by a false predicate")
+	}
+
+	called := false
+	if v, deleted := m.LoadAndDeleteIf("missing", func(*int) bool { called = true; return true }); v != nil || deleted || called {
+		t.Fatalf("LoadAndDeleteIf(missing) = %v, %v, pred called = %v", v, deleted, called)
+	}
+}
+
+func TestCap(t *testing.T) {
+	var m KVMap[int, int]
+	if c := m.Cap(); c != 0 {
+		t.Fatalf("Cap() of an empty map = %d", c)
+	}
+
+	for i := 0; i < 1000; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+	grown := m.Cap()
+	if grown < 1000 {
+		t.Fatalf("Cap() = %d after 1000 inserts", grown)
+	}
+
+	// Promote the entries, so that deleting them leaves tombstones behind.
+	m.Range(func(int, *int) bool { return true })
+	grown = m.Cap()
+
+	for i := 0; i < 1000; i++ {
+		m.Delete(i)
+	}
+	if c := m.Cap(); c < grown {
+		t.Fatalf("Cap() shrank from %d to %d on deletes alone", grown, c)
+	}
+
+	m.Clear()
+	if c := m.Cap(); c != 0 {
+		t.Fatalf("Cap() = %d after Clear", c)
+	}
+}
+
+func TestDrainIntoLosesNoIncrements(t *testing.T) {
+	var m KVMap[int, int64]
+
+	const writers, increments, keys = 4, 20000, 8
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				Add(&m, (w+i)%keys, 1)
+			}
+		}()
+	}
+
+	var total int64
+	flush := func() {
+		dst := make(map[int]*int64)
+		m.DrainInto(dst)
+		for _, v := range dst {
+			total += *v
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for flushing := true; flushing; {
+		select {
+		case <-done:
+			flushing = false
+		default:
+			flush()
+		}
+	}
+	flush()
+
+	if want := int64(writers * increments); total != want {
+		t.Fatalf("flushed %d increments in total, want %d", total, want)
+	}
+	if n := m.Len(); n != 0 {
+		t.Fatalf("Len() = %d after the final drain", n)
+	}
+}
+
+func TestRangeDeleteEveryKey(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		var m KVMap[int, int]
+		const n = 1000
+		for i := 0; i < n; i++ {
+			i := i
+			m.Store(i, &i)
+		}
+
+		// Promote half of the keys, so that the others are only in the dirty map
+		// when Range starts.
+		if round%2 == 0 {
+			m.Range(func(int, *int) bool { return true })
+			for i := n; i < 2*n; i++ {
+				i := i
+				m.Store(i, &i)
+			}
+		}
+
+		want := m.Len()
+		seen := make(map[int]int)
+		m.Range(func(k int, _ *int) bool {
+			seen[k]++
+			switch k % 3 {
+			case 0:
+				m.Delete(k)
+			case 1:
+				m.LoadAndDelete(k)
+			default:
+				v, _ := m.Load(k)
+				m.CompareAndDelete(k, v)
+			}
+			return true
+		})
+
+		if len(seen) != want {
+			t.Fatalf("round %d: visited %d keys, want %d", round, len(seen), want)
+		}
+		for k, c := range seen {
+			if c != 1 {
+				t.Fatalf("round %d: key %d visited %d times", round, k, c)
+			}
+		}
+		if l := m.Len(); l != 0 {
+			t.Fatalf("round %d: Len() = %d after deleting every visited key", round, l)
+		}
+	}
+}
+
+func TestContainsFast(t *testing.T) {
+	var m KVMap[string, int]
+	one := 1
+	m.Store("k", &one)
+
+	// A fresh key lives in the dirty map only.
+	if m.ContainsFast("k") {
+		t.Fatal("ContainsFast found a dirty-only key")
+	}
+	if !m.Contains("k") {
+		t.Fatal("Contains missed a dirty-only key")
+	}
+
+	m.Range(func(string, *int) bool { return true })
+	if !m.ContainsFast("k") {
+		t.Fatal("ContainsFast missed a promoted key")
+	}
+
+	m.Delete("k")
+	if m.ContainsFast("k") || m.Contains("k") {
+		t.Fatal("a deleted key is still reported as present")
+	}
+}
+
+func TestSwapKeys(t *testing.T) {
+	var m KVMap[string, int]
+	a, b := 1, 2
+	m.Store("a", &a)
+	m.Store("b", &b)
+
+	if !m.SwapKeys("a", "b") {
+		t.Fatal("SwapKeys(a, b) = false")
+	}
+	if va, _ := m.Load("a"); va != &b {
+		t.Errorf("Load(a) = %v, want %v", va, &b)
+	}
+	if vb, _ := m.Load("b"); vb != &a {
+		t.Errorf("Load(b) = %v, want %v", vb, &a)
+	}
+
+	if m.SwapKeys("a", "missing") || m.SwapKeys("missing", "a") {
+		t.Fatal("SwapKeys with an absent key = true")
+	}
+	if va, _ := m.Load("a"); va != &b {
+		t.Fatal("a failed SwapKeys changed the map")
+	}
+	if _, ok := m.Load("missing"); ok {
+		t.Fatal("a failed SwapKeys created the absent key")
+	}
+
+	if !m.SwapKeys("a", "a") {
+		t.Fatal("SwapKeys(a, a) = false")
+	}
+}
+
+func TestReplaceAllNoPartialTable(t *testing.T) {
+	var m KVMap[int, int]
+	const keys, generations = 100, 200
+
+	table := func(gen int) map[int]*int {
+		entries := make(map[int]*int, keys)
+		for k := 0; k < keys; k++ {
+			g := gen
+			entries[k] = &g
+		}
+		return entries
+	}
+	m.ReplaceAll(table(0))
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := 0
+			for i := 0; !stop.Load(); i++ {
+				v, ok := m.Load(i % keys)
+				if !ok {
+					t.Errorf("Load(%d) missed during ReplaceAll", i%keys)
+					return
+				}
+				// Each table is installed at once, so a reader never goes back to an
+				// older generation after seeing a newer one.
+				if *v < last {
+					t.Errorf("Load(%d) = generation %d after generation %d", i%keys, *v, last)
+					return
+				}
+				last = *v
+			}
+		}()
+	}
+
+	for gen := 1; gen <= generations; gen++ {
+		m.ReplaceAll(table(gen))
+	}
+	stop.Store(true)
+	wg.Wait()
+
+	if n := m.Len(); n != keys {
+		t.Fatalf("Len() = %d, want %d", n, keys)
+	}
+}
+
+func TestApproxLenConverges(t *testing.T) {
+	var m KVMap[int, int]
+
+	const writers, ops, keys = 8, 3000, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < ops; i++ {
+				k := r.Intn(keys)
+				v := i
+				switch r.Intn(8) {
+				case 0:
+					m.Store(k, &v)
+				case 1:
+					m.LoadOrStore(k, &v)
+				case 2:
+					m.Delete(k)
+				case 3:
+					m.LoadAndDelete(k)
+				case 4:
+					m.Swap(k, &v)
+				case 5:
+					if old, ok := m.Load(k); ok {
+						m.CompareAndSwap(k, old, &v)
+					}
+				case 6:
+					if old, ok := m.Load(k); ok {
+						m.CompareAndDelete(k, old)
+					}
+				default:
+					m.Range(func(int, *int) bool { return true })
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if approx, exact := m.ApproxLen(), m.Len(); approx != int64(exact) {
+		t.Fatalf("ApproxLen() = %d after writers settled, Len() = %d", approx, exact)
+	}
+}
+
+func TestCompareAndSwapAll(t *testing.T) {
+	var m KVMap[string, int]
+	a, b, a2, b2, c := 1, 2, 10, 20, 3
+	m.Store("a", &a)
+	m.Store("b", &b)
+
+	// One mismatch aborts the whole batch.
+	other := 2
+	if m.CompareAndSwapAll(map[string]struct{ Old, New *int }{
+		"a": {&a, &a2},
+		"b": {&other, &b2},
+		"c": {nil, &c},
+	}) {
+		t.Fatal("CompareAndSwapAll with a mismatched Old succeeded")
+	}
+	if va, _ := m.Load("a"); va != &a {
+		t.Fatal("an aborted batch changed a")
+	}
+	if _, ok := m.Load("c"); ok {
+		t.Fatal("an aborted batch created c")
+	}
+
+	if !m.CompareAndSwapAll(map[string]struct{ Old, New *int }{
+		"a": {&a, &a2},
+		"b": {&b, nil},
+		"c": {nil, &c},
+	}) {
+		t.Fatal("CompareAndSwapAll with matching values failed")
+	}
+	if va, _ := m.Load("a"); va != &a2 {
+		t.Error("a was not swapped")
+	}
+	if _, ok := m.Load("b"); ok {
+		t.Error("b was not deleted")
+	}
+	if vc, _ := m.Load("c"); vc != &c {
+		t.Error("c was not created")
+	}
+}
+
+func TestRangeChunks(t *testing.T) {
+	var m KVMap[int, int]
+	for i := 0; i < 23; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+
+	var sizes []int
+	seen := make(map[int]bool)
+	m.RangeChunks(5, func(chunk []KV[int, int]) bool {
+		sizes = append(sizes, len(chunk))
+		for _, kv := range chunk {
+			if kv.Key != kv.Value || seen[kv.Key] {
+				t.Errorf("unexpected pair %v", kv)
+			}
+			seen[kv.Key] = true
+		}
+		return true
+	})
+
+	if want := []int{5, 5, 5, 5, 3}; !slices.Equal(sizes, want) {
+		t.Fatalf("chunk sizes = %v, want %v", sizes, want)
+	}
+	if len(seen) != 23 {
+		t.Fatalf("chunks covered %d keys, want 23", len(seen))
+	}
+
+	calls := 0
+	m.RangeChunks(5, func([]KV[int, int]) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Fatalf("f called %d times after returning false, want 1", calls)
+	}
+
+	new(KVMap[int, int]).RangeChunks(5, func([]KV[int, int]) bool {
+		t.Fatal("RangeChunks called f for an empty map")
+		return true
+	})
+}
+
+func TestClearFunc(t *testing.T) {
+	var m KVMap[int, int]
+	for i := 0; i < 50; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+	m.Range(func(int, *int) bool { return true })
+	for i := 50; i < 60; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+	for i := 0; i < 60; i += 6 {
+		m.Delete(i)
+	}
+
+	cleaned := make(map[int]int)
+	m.ClearFunc(func(k int, v *int) {
+		if *v != k {
+			t.Errorf("cleanup(%d, %d)", k, *v)
+		}
+		cleaned[k]++
+
+		// cleanup runs without the lock, so it may use the map.
+		m.Load(k)
+	})
+
+	if len(cleaned) != 50 {
+		t.Fatalf("cleanup called for %d keys, want the 50 live ones", len(cleaned))
+	}
+	for k, n := range cleaned {
+		if n != 1 || k%6 == 0 {
+			t.Errorf("cleanup called %d times for key %d", n, k)
+		}
+	}
+	if n := m.Len(); n != 0 {
+		t.Fatalf("Len() = %d after ClearFunc", n)
+	}
+}
+
+func TestLoadOrInitOnceRetriesAfterFailure(t *testing.T) {
+	var m KVMap[string, int]
+	boom := errors.New("boom")
+
+	calls := 0
+	init := func() (*int, error) {
+		calls++
+		if calls == 1 {
+			return nil, boom
+		}
+		v := 42
+		return &v, nil
+	}
+
+	if v, err := m.LoadOrInitOnce("k", init); !errors.Is(err, boom) || v != nil {
+		t.Fatalf("first LoadOrInitOnce = %v, %v; want nil, boom", v, err)
+	}
+	if _, ok := m.Load("k"); ok {
+		t.Fatal("a failed init stored a value")
+	}
+
+	v, err := m.LoadOrInitOnce("k", init)
+	if err != nil || *v != 42 {
+		t.Fatalf("second LoadOrInitOnce = %v, %v; want 42", v, err)
+	}
+	if again, _ := m.LoadOrInitOnce("k", init); again != v || calls != 2 {
+		t.Fatalf("init called %d times, want 2: a successful init must be memoized", calls)
+	}
+}
+
+func TestLoadOrInitOnceSharesInit(t *testing.T) {
+	var m KVMap[string, int]
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	init := func() (*int, error) {
+		calls.Add(1)
+		<-release
+		v := 7
+		return &v, nil
+	}
+
+	const callers = 16
+	results := make([]*int, callers)
+	var wg sync.WaitGroup
+	for i := range results {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := m.LoadOrInitOnce("k", init)
+			if err != nil {
+				t.Errorf("LoadOrInitOnce: %v", err)
+			}
+			results[i] = v
+		}()
+	}
+
+	for calls.Load() == 0 {
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("init called %d times, want 1", n)
+	}
+	for i, v := range results {
+		if v != results[0] || *v != 7 {
+			t.Fatalf("caller %d got %v, want the shared result %v", i, v, results[0])
+		}
+	}
+}
+
+func TestLoadOrInitOncePanic(t *testing.T) {
+	var m KVMap[string, int]
+
+	func() {
+		defer func() { _ = recover() }()
+		m.LoadOrInitOnce("k", func() (*int, error) { panic("boom") })
+	}()
+
+	v, err := m.LoadOrInitOnce("k", func() (*int, error) {
+		v := 1
+		return &v, nil
+	})
+	if err != nil || *v != 1 {
+		t.Fatalf("LoadOrInitOnce after a panicking init = %v, %v", v, err)
+	}
+}
+
+func TestPathStats(t *testing.T) {
+	m := &KVMap[string, int]{CountPaths: true}
+	one, two := 1, 2
+
+	m.Store("promoted", &one)
+	m.Range(func(string, *int) bool { return true })
+	m.Store("promoted", &two)
+	m.Store("dirty", &one)
+
+	// The update of a promoted key stays in the read-only snapshot, so reading it
+	// back is lock-free; the new key is only in the dirty map.
+	m.Load("promoted")
+	fast, slow, writes := m.PathStats()
+	if fast != 1 || slow != 0 {
+		t.Fatalf("after reading a promoted key: fast = %d, slow = %d; want 1, 0", fast, slow)
+	}
+
+	m.Load("dirty")
+	fast, slow, _ = m.PathStats()
+	if fast != 1 || slow != 1 {
+		t.Fatalf("after reading a dirty-only key: fast = %d, slow = %d; want 1, 1", fast, slow)
+	}
+	if writes != 3 {
+		t.Fatalf("writes = %d, want 3", writes)
+	}
+
+	var off KVMap[string, int]
+	off.Store("k", &one)
+	off.Load("k")
+	if fast, slow, writes := off.PathStats(); fast+slow+writes != 0 {
+		t.Fatal("PathStats counted without CountPaths")
+	}
+}
+
+func TestLoadOrStoreMany(t *testing.T) {
+	var m KVMap[string, int]
+	old, a, b := 1, 2, 3
+	m.Store("old", &old)
+
+	actual, anyStored := m.LoadOrStoreMany(map[string]*int{"old": &a, "new": &b, "nil": nil})
+	if !anyStored {
+		t.Fatal("anyStored = false although new was inserted")
+	}
+	if actual["old"] != &old {
+		t.Error("an existing value was overwritten")
+	}
+	if actual["new"] != &b {
+		t.Error("a new key was not stored")
+	}
+	if v, ok := actual["nil"]; !ok || v != nil {
+		t.Error("a nil value should map to nil")
+	}
+	if _, ok := m.Load("nil"); ok {
+		t.Error("a nil value was stored")
+	}
+
+	if _, anyStored := m.LoadOrStoreMany(map[string]*int{"old": &a, "new": &a}); anyStored {
+		t.Fatal("anyStored = true although every key was present")
+	}
+}
+
+func TestRangeSafe(t *testing.T) {
+	type record struct{ n int }
+
+	var m KVMap[string, record]
+	stored := &record{1}
+	m.Store("k", stored)
+
+	var get func() record
+	m.RangeSafe(func(_ string, g func() record) bool {
+		get = g
+		return true
+	})
+
+	v := get()
+	if v.n != 1 {
+		t.Fatalf("get() = %v, want the current content", v)
+	}
+	v.n = 100
+	if stored.n != 1 || get().n != 1 {
+		t.Fatal("writing to a copy from get changed the stored value")
+	}
+}
+
+func TestLoadOrComputeSingleFlightComputesOnce(t *testing.T) {
+	var m KVMap[string, int]
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	compute := func(context.Context) (*int, error) {
+		calls.Add(1)
+		<-release
+		v := 9
+		return &v, nil
+	}
+
+	const callers = 32
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := m.LoadOrComputeSingleFlight(context.Background(), "k", compute)
+			if err != nil || *v != 9 {
+				t.Errorf("LoadOrComputeSingleFlight = %v, %v", v, err)
+			}
+		}()
+	}
+
+	for calls.Load() == 0 {
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("compute ran %d times for %d concurrent misses, want 1", n, callers)
+	}
+}
+
+func TestLoadOrComputeSingleFlightWaiterCanceled(t *testing.T) {
+	var m KVMap[string, int]
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go m.LoadOrComputeSingleFlight(context.Background(), "k", func(context.Context) (*int, error) {
+		close(started)
+		<-release
+		v := 1
+		return &v, nil
+	})
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := m.LoadOrComputeSingleFlight(ctx, "k", nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("waiter with a done ctx: err = %v, want context.Canceled", err)
+	}
+	close(release)
+}
+
+func TestRangeStable(t *testing.T) {
+	type point struct{ x, y int }
+
+	var m KVMap[point, int]
+	for i := 0; i < 50; i++ {
+		i := i
+		m.Store(point{i % 7, i}, &i)
+	}
+
+	keyStr := func(p point) string { return fmt.Sprint(p.x, ",", p.y) }
+	order := func() []point {
+		var keys []point
+		m.RangeStable(keyStr, func(k point, _ *int) bool {
+			keys = append(keys, k)
+			return true
+		})
+		return keys
+	}
+
+	first := order()
+	if len(first) != 50 {
+		t.Fatalf("RangeStable visited %d keys, want 50", len(first))
+	}
+	if !sort.SliceIsSorted(first, func(i, j int) bool { return keyStr(first[i]) < keyStr(first[j]) }) {
+		t.Fatal("RangeStable did not visit keys in keyStr order")
+	}
+	for run := 0; run < 10; run++ {
+		if again := order(); !slices.Equal(again, first) {
+			t.Fatalf("run %d visited %v, first run visited %v", run, again, first)
+		}
+	}
+}
+
+func TestUpdateAndGetConcurrent(t *testing.T) {
+	var m KVMap[string, int]
+	inc := func(old *int, loaded bool) *int {
+		n := 1
+		if loaded {
+			n = *old + 1
+		}
+		return &n
+	}
+
+	const goroutines, calls = 8, 500
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < calls; j++ {
+				if _, ok := m.UpdateAndGet("k", inc); !ok {
+					t.Error("UpdateAndGet returned ok = false for a non-nil result")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v, _ := m.Load("k"); *v != goroutines*calls {
+		t.Fatalf("final value = %d, want %d", *v, goroutines*calls)
+	}
+
+	if v, ok := m.UpdateAndGet("k", func(*int, bool) *int { return nil }); ok || v != nil {
+		t.Fatalf("UpdateAndGet returning nil = %v, %v; want nil, false", v, ok)
+	}
+	if _, ok := m.Load("k"); ok {
+		t.Fatal("a nil result did not delete the key")
+	}
+}
+
+func TestPromote(t *testing.T) {
+	var promotions int
+	m := &KVMap[int, int]{CountPaths: true, OnPromote: func(int) { promotions++ }}
+
+	bulk := make(map[int]*int)
+	for i := 0; i < 100; i++ {
+		i := i
+		bulk[i] = &i
+	}
+	m.LoadOrStoreMany(bulk)
+
+	m.Promote()
+	if promotions != 1 {
+		t.Fatalf("OnPromote called %d times, want 1", promotions)
+	}
+
+	for i := 0; i < 100; i++ {
+		m.Load(i)
+	}
+	if fast, slow, _ := m.PathStats(); fast != 100 || slow != 0 {
+		t.Fatalf("after Promote: fast = %d, slow = %d; want 100, 0", fast, slow)
+	}
+
+	m.Promote()
+	if promotions != 1 {
+		t.Fatal("Promote without pending writes promoted again")
+	}
+}
+
+func TestForkIsIndependent(t *testing.T) {
+	var m KVMap[string, int]
+	a, b := 1, 2
+	m.Store("a", &a)
+	m.Store("b", &b)
+
+	f := m.Fork()
+
+	c := 3
+	f.Store("a", &c)
+	f.Delete("b")
+	f.Store("c", &c)
+	if v, _ := m.Load("a"); v != &a {
+		t.Error("a write to the fork changed the parent")
+	}
+	if _, ok := m.Load("b"); !ok {
+		t.Error("a delete on the fork removed the parent's key")
+	}
+	if _, ok := m.Load("c"); ok {
+		t.Error("a key added to the fork appeared in the parent")
+	}
+
+	d := 4
+	m.Store("b", &d)
+	m.Store("d", &d)
+	if _, ok := f.Load("b"); ok {
+		t.Error("a write to the parent resurrected the fork's deleted key")
+	}
+	if _, ok := f.Load("d"); ok {
+		t.Error("a key added to the parent appeared in the fork")
+	}
+}
+
+func TestForkSharesSnapshot(t *testing.T) {
+	fill := func() (*KVMap[int, int], []*int) {
+		var m KVMap[int, int]
+		ptrs := make([]*int, 10)
+		for i := range ptrs {
+			v := i
+			ptrs[i] = &v
+			m.Store(i, &v)
+		}
+		return &m, ptrs
+	}
+
+	// Each write is applied to one side of a fork, and must leave the other side
+	// with exactly the entries it had.
+	writes := map[string]func(m *KVMap[int, int], ptrs []*int){
+		"Swap": func(m *KVMap[int, int], ptrs []*int) {
+			x := -1
+			m.Swap(0, &x)
+		},
+		"CompareAndSwap": func(m *KVMap[int, int], ptrs []*int) {
+			x := -1
+			if !m.CompareAndSwap(1, ptrs[1], &x) {
+				t.Error("CompareAndSwap on a fresh fork failed")
+			}
+		},
+		"LoadAndDelete": func(m *KVMap[int, int], ptrs []*int) {
+			m.LoadAndDelete(2)
+		},
+		"CompareAndDelete": func(m *KVMap[int, int], ptrs []*int) {
+			if !m.CompareAndDelete(3, ptrs[3]) {
+				t.Error("CompareAndDelete on a fresh fork failed")
+			}
+		},
+		"DeleteThenLoadOrStore": func(m *KVMap[int, int], ptrs []*int) {
+			m.Delete(4)
+			x := -1
+			m.LoadOrStore(4, &x)
+		},
+		"TrimDirty": func(m *KVMap[int, int], ptrs []*int) {
+			m.Delete(5)
+			m.TrimDirty()
+		},
+		"Clear": func(m *KVMap[int, int], ptrs []*int) {
+			m.Clear()
+		},
+	}
+
+	check := func(t *testing.T, m *KVMap[int, int], ptrs []*int) {
+		t.Helper()
+		if n := m.Len(); n != len(ptrs) {
+			t.Errorf("Len() = %d, want %d", n, len(ptrs))
+		}
+		for i, p := range ptrs {
+			if v, ok := m.Load(i); !ok || v != p {
+				t.Errorf("Load(%d) = %v, %v; want %v, true", i, v, ok, p)
+			}
+		}
+	}
+
+	for name, write := range writes {
+		write := write
+		t.Run(name+"/Fork", func(t *testing.T) {
+			m, ptrs := fill()
+			write(m.Fork(), ptrs)
+			check(t, m, ptrs)
+		})
+		t.Run(name+"/Parent", func(t *testing.T) {
+			m, ptrs := fill()
+			f := m.Fork()
+			write(m, ptrs)
+			check(t, f, ptrs)
+		})
+	}
+
+	t.Run("ForkOfFork", func(t *testing.T) {
+		m, ptrs := fill()
+		f := m.Fork()
+		g := f.Fork()
+
+		x := -1
+		f.Store(0, &x)
+		g.Delete(1)
+		check(t, m, ptrs)
+		if v, _ := g.Load(0); v != ptrs[0] {
+			t.Error("a write to a fork changed the fork made from it")
+		}
+		if _, ok := f.Load(1); !ok {
+			t.Error("a delete on a fork of a fork removed the key from its parent")
+		}
+	})
+
+	t.Run("Pending", func(t *testing.T) {
+		m, ptrs := fill()
+		x := 10
+		m.Store(10, &x) // only in the dirty map
+		f := m.Fork()
+		if v, ok := f.Load(10); !ok || v != &x {
+			t.Errorf("Load(10) on the fork = %v, %v; want the pending write", v, ok)
+		}
+		check(t, f, append(ptrs, &x))
+	})
+}
+
+// TestForkConcurrentUpdates forks a map repeatedly while other goroutines update its
+// existing keys in place, and checks that no update lands in a fork after Fork has
+// returned.
+func TestForkConcurrentUpdates(t *testing.T) {
+	const keys = 16
+
+	var m KVMap[int, int]
+	for i := 0; i < keys; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				k := (w + i) % keys
+				old, _ := m.Load(k)
+				x := i
+				switch i % 3 {
+				case 0:
+					m.CompareAndSwap(k, old, &x)
+				case 1:
+					m.Swap(k, &x)
+				default:
+					m.CompareAndDelete(k, old)
+					m.LoadOrStore(k, &x)
+				}
+
+				runtime.Gosched()
+			}
+		}()
+	}
+
+	for round := 0; round < 200; round++ {
+		f := m.Fork()
+		want := make(map[int]*int, keys)
+		f.Range(func(k int, v *int) bool {
+			want[k] = v
+			return true
+		})
+
+		runtime.Gosched()
+
+		got := make(map[int]*int, keys)
+		f.Range(func(k int, v *int) bool {
+			got[k] = v
+			return true
+		})
+		if !maps.Equal(got, want) {
+			t.Fatalf("round %d: the fork changed after Fork returned", round)
+		}
+	}
+
+	close(done)
+	wg.Wait()
+}
+
+// BenchmarkFork measures Fork at several sizes. Fork shares the read-only snapshot
+// instead of copying it, so its cost does not depend on the size of the map; the
+// copy is paid on the first write to each side, as BenchmarkForkThenWrite shows.
+func BenchmarkFork(b *testing.B) {
+	for _, n := range []int{10, 1000, 100000} {
+		b.Run("Entries="+strconv.Itoa(n), func(b *testing.B) {
+			var m KVMap[int, int]
+			for i := 0; i < n; i++ {
+				i := i
+				m.Store(i, &i)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m.Fork()
+			}
+		})
+	}
+}
+
+// BenchmarkForkThenWrite measures a Fork followed by a write to the fork, which
+// makes the fork copy the entries it shares with the parent.
+func BenchmarkForkThenWrite(b *testing.B) {
+	for _, n := range []int{10, 1000, 100000} {
+		b.Run("Entries="+strconv.Itoa(n), func(b *testing.B) {
+			var m KVMap[int, int]
+			for i := 0; i < n; i++ {
+				i := i
+				m.Store(i, &i)
+			}
+
+			x := -1
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m.Fork().Store(0, &x)
+			}
+		})
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	var m KVMap[int, int]
+	for i := 0; i < 100; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+
+	lookup := m.Freeze()
+
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				k := i % 100
+				if v, ok := lookup(k); !ok || *v != k {
+					t.Errorf("lookup(%d) = %v, %v", k, v, ok)
+					return
+				}
+			}
+		}()
+	}
+
+	// Writes made after Freeze, concurrently with the lookups, are not visible
+	// through them.
+	for i := 0; i < 100; i++ {
+		n := -i
+		m.Store(i, &n)
+		m.Store(i+100, &n)
+	}
+	m.Delete(0)
+	wg.Wait()
+
+	if v, ok := lookup(0); !ok || *v != 0 {
+		t.Fatalf("lookup(0) = %v, %v after Delete, want the frozen 0", v, ok)
+	}
+	if _, ok := lookup(150); ok {
+		t.Fatal("a key stored after Freeze is visible through the lookup")
+	}
+}
+
+func TestKeysAppendAndEntriesInto(t *testing.T) {
+	var m KVMap[int, int]
+	for i := 0; i < 10; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+
+	keys := m.KeysAppend([]int{-1})
+	if len(keys) != 11 || keys[0] != -1 {
+		t.Fatalf("KeysAppend did not append to dst: %v", keys)
+	}
+	slices.Sort(keys)
+	if want := []int{-1, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9}; !slices.Equal(keys, want) {
+		t.Fatalf("KeysAppend = %v, want %v", keys, want)
+	}
+
+	dst := map[int]*int{100: nil}
+	m.EntriesInto(dst)
+	if len(dst) != 10 {
+		t.Fatalf("EntriesInto left %d entries, want the 10 live ones", len(dst))
+	}
+	if _, ok := dst[100]; ok {
+		t.Fatal("EntriesInto did not clear dst")
+	}
+}
+
+func BenchmarkKeysAppend(b *testing.B) {
+	var m KVMap[int, int]
+	for i := 0; i < 1000; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+	m.Promote()
+
+	keys := m.KeysAppend(nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		keys = m.KeysAppend(keys[:0])
+	}
+}
+
+func BenchmarkEntriesInto(b *testing.B) {
+	var m KVMap[int, int]
+	for i := 0; i < 1000; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+	m.Promote()
+
+	dst := make(map[int]*int)
+	m.EntriesInto(dst)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.EntriesInto(dst)
+	}
+}
+
+func TestRangeSample(t *testing.T) {
+	var m KVMap[int, int]
+	for i := 0; i < 100; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+
+	for _, n := range []int{0, -1, 1, 10, 100, 1000} {
+		visited := 0
+		m.RangeSample(n, func(int, *int) bool {
+			visited++
+			return true
+		})
+
+		want := n
+		if want < 0 {
+			want = 0
+		}
+		if want > 100 {
+			want = 100
+		}
+		if visited != want {
+			t.Errorf("RangeSample(%d) visited %d entries, want %d", n, visited, want)
+		}
+	}
+}
+
+func TestExchange(t *testing.T) {
+	one, two := 1, 2
+	for _, tc := range []struct {
+		name     string
+		present  bool
+		value    *int
+		wantPrev *int
+		wantHad  bool
+		wantLoad *int
+	}{
+		{"absent, nil", false, nil, nil, false, nil},
+		{"absent, non-nil", false, &two, nil, false, &two},
+		{"present, nil", true, nil, &one, true, nil},
+		{"present, non-nil", true, &two, &one, true, &two},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var m KVMap[string, int]
+			if tc.present {
+				m.Store("k", &one)
+			}
+
+			prev, had := m.Exchange("k", tc.value)
+			if prev != tc.wantPrev || had != tc.wantHad {
+				t.Fatalf("Exchange = %v, %v; want %v, %v", prev, had, tc.wantPrev, tc.wantHad)
+			}
+			if v, _ := m.Load("k"); v != tc.wantLoad {
+				t.Fatalf("Load after Exchange = %v, want %v", v, tc.wantLoad)
+			}
+		})
+	}
+}
+
+func TestRangeAndDelete(t *testing.T) {
+	var m KVMap[int, int]
+	for i := 0; i < 10; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+
+	seen := 0
+	m.RangeAndDelete(func(k int, v *int) bool {
+		if *v != k {
+			t.Errorf("RangeAndDelete: %d = %d", k, *v)
+		}
+		if _, ok := m.Load(k); ok {
+			t.Errorf("key %d still present when passed to f", k)
+		}
+		seen++
+		return seen < 4
+	})
+	if seen != 4 {
+		t.Fatalf("f called %d times after returning false, want 4", seen)
+	}
+	if n := m.Len(); n != 6 {
+		t.Fatalf("Len() = %d, want 6", n)
+	}
+}
+
+func TestRangeAndDeleteConcurrent(t *testing.T) {
+	const (
+		writers = 4
+		writes  = 2000
+		keys    = 32
+	)
+
+	var (
+		m       KVMap[int, int]
+		mu      sync.Mutex
+		handled = make(map[int]int)
+	)
+	account := func(v int) {
+		mu.Lock()
+		handled[v]++
+		mu.Unlock()
+	}
+
+	// Every value is unique. It must end up handed to RangeAndDelete, returned by
+	// the Swap that replaced it, or still in the map, exactly once.
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				v := w*writes + i
+				if prev, loaded := m.Swap(i%keys, &v); loaded {
+					account(*prev)
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 0; n < 50; n++ {
+			m.RangeAndDelete(func(_ int, v *int) bool {
+				account(*v)
+				return true
+			})
+		}
+	}()
+	wg.Wait()
+	<-done
+
+	m.Range(func(_ int, v *int) bool {
+		account(*v)
+		return true
+	})
+	for v := 0; v < writers*writes; v++ {
+		if n := handled[v]; n != 1 {
+			t.Fatalf("value %d accounted for %d times, want 1", v, n)
+		}
+	}
+}
+
+func TestEstimateBytes(t *testing.T) {
+	var empty KVMap[int, int]
+	if n := empty.EstimateBytes(); n != 0 {
+		t.Fatalf("EstimateBytes() = %d on an empty map, want 0", n)
+	}
+
+	estimate := func(n int) int64 {
+		var m KVMap[int, int]
+		for i := 0; i < n; i++ {
+			i := i
+			m.Store(i, &i)
+		}
+		m.Promote()
+		return m.EstimateBytes()
+	}
+
+	small, big := estimate(1000), estimate(10000)
+	if small <= 0 {
+		t.Fatalf("EstimateBytes() = %d for 1000 entries", small)
+	}
+	if ratio := float64(big) / float64(small); ratio < 8 || ratio > 12 {
+		t.Fatalf("EstimateBytes() grew %.2fx for 10x the entries (%d -> %d)", ratio, small, big)
+	}
+}
+
+func TestContainsAllAny(t *testing.T) {
+	var m KVMap[string, int]
+	one := 1
+	m.Store("a", &one)
+	m.Store("b", &one)
+
+	for _, tc := range []struct {
+		name     string
+		keys     []string
+		all, any bool
+	}{
+		{"AllPresent", []string{"a", "b"}, true, true},
+		{"SomeMissing", []string{"a", "x"}, false, true},
+		{"NonePresent", []string{"x", "y"}, false, false},
+		{"Empty", nil, true, false},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if got := m.ContainsAll(tc.keys...); got != tc.all {
+				t.Errorf("ContainsAll(%v) = %v, want %v", tc.keys, got, tc.all)
+			}
+			if got := m.ContainsAny(tc.keys...); got != tc.any {
+				t.Errorf("ContainsAny(%v) = %v, want %v", tc.keys, got, tc.any)
+			}
+		})
+	}
+}
+
+func TestMoveFunc(t *testing.T) {
+	var src, dst KVMap[int, int]
+	for i := 0; i < 100; i++ {
+		i := i
+		src.Store(i, &i)
+	}
+
+	moved := src.MoveFunc(&dst, func(k int, _ *int) bool { return k%3 == 0 })
+	if moved != 34 {
+		t.Fatalf("MoveFunc moved %d entries, want 34", moved)
+	}
+
+	for i := 0; i < 100; i++ {
+		vs, ins := src.Load(i)
+		vd, ind := dst.Load(i)
+		if ins == ind {
+			t.Fatalf("key %d in src = %v, in dst = %v; want exactly one", i, ins, ind)
+		}
+		if i%3 == 0 && (!ind || *vd != i) {
+			t.Fatalf("dst.Load(%d) = %v, %v", i, vd, ind)
+		}
+		if i%3 != 0 && (!ins || *vs != i) {
+			t.Fatalf("src.Load(%d) = %v, %v", i, vs, ins)
+		}
+	}
+}
+
+func TestRangeErr(t *testing.T) {
+	var m KVMap[int, int]
+	for i := 0; i < 10; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+
+	if err := m.RangeErr(func(int, *int) error { return nil }); err != nil {
+		t.Fatalf("RangeErr() = %v when every call returned nil", err)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err := m.RangeErr(func(int, *int) error {
+		calls++
+		if calls == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Fatalf("RangeErr() = %v, want %v", err, stop)
+	}
+	if calls != 3 {
+		t.Fatalf("f called %d times, want 3", calls)
+	}
+}
+
+// waitGoroutines waits for the number of goroutines to drop back to n.
+func waitGoroutines(t *testing.T, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines running, want %d", runtime.NumGoroutine(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDrainChan(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	var m KVMap[int, int]
+	for i := 0; i < 100; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+
+	seen := make(map[int]bool)
+	for kv := range m.DrainChan(context.Background(), 4) {
+		if kv.Key != kv.Value || seen[kv.Key] {
+			t.Fatalf("DrainChan sent %+v (seen before: %v)", kv, seen[kv.Key])
+		}
+		seen[kv.Key] = true
+	}
+	if len(seen) != 100 {
+		t.Fatalf("DrainChan sent %d entries, want 100", len(seen))
+	}
+	if n := m.Len(); n != 0 {
+		t.Fatalf("Len() = %d after the drain, want 0", n)
+	}
+
+	waitGoroutines(t, before)
+}
+
+func TestDrainChanCanceled(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	var m KVMap[int, int]
+	for i := 0; i < 100; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := m.DrainChan(ctx, 0)
+	received := 0
+	for range ch {
+		received++
+		if received == 10 {
+			break
+		}
+	}
+	cancel()
+	for range ch {
+		received++
+	}
+
+	// Entries not sent before the cancellation stay in the map.
+	if n := m.Len(); n+received != 100 {
+		t.Fatalf("received %d entries and %d remain, want 100 in total", received, n)
+	}
+
+	waitGoroutines(t, before)
+}
+
+func TestLoadOrElse(t *testing.T) {
+	var m KVMap[string, int]
+	one, fallback := 1, -1
+	m.Store("a", &one)
+
+	calls := 0
+	elseFn := func() *int { calls++; return &fallback }
+
+	if v := m.LoadOrElse("a", elseFn); v != &one || calls != 0 {
+		t.Fatalf("LoadOrElse(a) = %v with %d elseFn calls; want the stored value and none", v, calls)
+	}
+	if v := m.LoadOrElse("b", elseFn); v != &fallback || calls != 1 {
+		t.Fatalf("LoadOrElse(b) = %v with %d elseFn calls; want the fallback and one", v, calls)
+	}
+	if _, ok := m.Load("b"); ok {
+		t.Fatal("LoadOrElse stored the fallback")
+	}
+}
+
+func TestTakeAndReset(t *testing.T) {
+	var m KVMap[string, int]
+	if taken, ok := m.TakeAndReset("absent", new(int)); ok || taken != nil {
+		t.Fatalf("TakeAndReset on an absent key = %v, %v", taken, ok)
+	}
+	if m.Contains("absent") {
+		t.Fatal("TakeAndReset created an absent key")
+	}
+
+	const (
+		producers = 4
+		adds      = 2000
+	)
+	m.Store("k", new(int))
+
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < adds; i++ {
+				for {
+					old, _ := m.Load("k")
+					next := *old + 1
+					if m.CompareAndSwap("k", old, &next) {
+						break
+					}
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	total := 0
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			taken, ok := m.TakeAndReset("k", new(int))
+			if !ok {
+				t.Error("TakeAndReset missed the key")
+				return
+			}
+			total += *taken
+			runtime.Gosched()
+		}
+	}()
+	wg.Wait()
+	<-done
+
+	last, _ := m.Load("k")
+	if total += *last; total != producers*adds {
+		t.Fatalf("taken and remaining add up to %d, want %d", total, producers*adds)
+	}
+}
+
+func TestWaitForSize(t *testing.T) {
+	var m KVMap[int, int]
+
+	errc := make(chan error, 1)
+	go func() { errc <- m.WaitForSize(context.Background(), 5) }()
+
+	for i := 0; i < 5; i++ {
+		select {
+		case err := <-errc:
+			t.Fatalf("WaitForSize returned %v with %d entries", err, i)
+		default:
+		}
+
+		i := i
+		m.Store(i, &i)
+	}
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("WaitForSize() = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForSize did not return once the map held 5 entries")
+	}
+
+	// A size already reached returns at once.
+	if err := m.WaitForSize(context.Background(), 3); err != nil {
+		t.Fatalf("WaitForSize(3) = %v", err)
+	}
+}
+
+func TestWaitForSizeCanceled(t *testing.T) {
+	var m KVMap[int, int]
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := m.WaitForSize(ctx, 1); err != context.DeadlineExceeded {
+		t.Fatalf("WaitForSize() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestClearCount(t *testing.T) {
+	var m KVMap[int, int]
+	for i := 0; i < 100; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+	m.Promote()
+	for i := 100; i < 150; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+	m.Delete(0)
+
+	if n := m.ClearCount(); n != 149 {
+		t.Fatalf("ClearCount() = %d, want 149", n)
+	}
+	if n := m.Len(); n != 0 {
+		t.Fatalf("Len() = %d after ClearCount", n)
+	}
+	if n := m.ClearCount(); n != 0 {
+		t.Fatalf("ClearCount() = %d on an empty map", n)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	var m KVMap[int, int]
+	ptrs := make(map[int]*int)
+	for i := 0; i < 10; i++ {
+		i := i
+		m.Store(i, &i)
+		ptrs[i] = &i
+	}
+
+	m.Walk(func(k int, v *int) { *v = k * 10 })
+
+	for i := 0; i < 10; i++ {
+		v, ok := m.Load(i)
+		if !ok || *v != i*10 {
+			t.Fatalf("Load(%d) = %v, %v after Walk; want %d", i, v, ok, i*10)
+		}
+		if v != ptrs[i] {
+			t.Fatalf("Walk replaced the pointer of %d instead of editing in place", i)
+		}
+	}
+}
+
+func TestRangeCollectDeletes(t *testing.T) {
+	var m KVMap[int, int]
+	for i := 0; i < 20; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+
+	// f sees the whole map, so a decision that depends on another key is not
+	// affected by deletions made earlier in the same pass.
+	deleted := m.RangeCollectDeletes(func(k int, v *int) bool {
+		if k%2 == 1 && !m.Contains(k-1) {
+			t.Errorf("key %d gone while f was still running", k-1)
+		}
+		return *v%2 == 0
+	})
+	if deleted != 10 {
+		t.Fatalf("RangeCollectDeletes() = %d, want 10", deleted)
+	}
+	for i := 0; i < 20; i++ {
+		if got, want := m.Contains(i), i%2 == 1; got != want {
+			t.Fatalf("Contains(%d) = %v, want %v", i, got, want)
+		}
+	}
+
+	// A value replaced after f saw it is left in place.
+	replaced := -1
+	deleted = m.RangeCollectDeletes(func(k int, _ *int) bool {
+		if k == 1 {
+			m.Store(1, &replaced)
+		}
+		return true
+	})
+	if deleted != 9 {
+		t.Fatalf("RangeCollectDeletes() = %d, want 9", deleted)
+	}
+	if v, ok := m.Load(1); !ok || v != &replaced {
+		t.Fatalf("Load(1) = %v, %v; want the value stored during the pass", v, ok)
+	}
+}
+
+func TestStoreIfAbsentOrMatch(t *testing.T) {
+	var m KVMap[string, string]
+	mine, renewed, theirs := "mine", "renewed", "theirs"
+
+	// Absent: the lease is free.
+	if !m.StoreIfAbsentOrMatch("lease", nil, &mine) {
+		t.Fatal("StoreIfAbsentOrMatch on an absent key did not store")
+	}
+
+	// Match: the holder renews its lease.
+	if !m.StoreIfAbsentOrMatch("lease", &mine, &renewed) {
+		t.Fatal("StoreIfAbsentOrMatch with the current value did not store")
+	}
+	if v, _ := m.Load("lease"); v != &renewed {
+		t.Fatalf("Load(lease) = %q, want the renewed lease", *v)
+	}
+
+	// Mismatch: someone else holds the lease.
+	if m.StoreIfAbsentOrMatch("lease", &mine, &theirs) {
+		t.Fatal("StoreIfAbsentOrMatch with a stale value stored")
+	}
+	if v, _ := m.Load("lease"); v != &renewed {
+		t.Fatalf("Load(lease) = %q after a mismatch, want it unchanged", *v)
+	}
+
+	// A nil new releases the lease on a match.
+	if !m.StoreIfAbsentOrMatch("lease", &renewed, nil) {
+		t.Fatal("StoreIfAbsentOrMatch did not release the lease")
+	}
+	if m.Contains("lease") {
+		t.Fatal("released lease still present")
+	}
+}
+
+func TestLoadForUpdate(t *testing.T) {
+	var m KVMap[string, int]
+	if _, ok := m.LoadForUpdate("absent"); ok {
+		t.Fatal("LoadForUpdate found an absent key")
+	}
+
+	zero := 0
+	m.Store("k", &zero)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				for {
+					old, ok := m.LoadForUpdate("k")
+					if !ok {
+						t.Error("LoadForUpdate missed the key")
+						return
+					}
+					next := *old + 1
+					if m.CompareAndSwap("k", old, &next) {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v, _ := m.Load("k"); *v != 4000 {
+		t.Fatalf("counter = %d after 4000 read-modify-write updates", *v)
+	}
+
+	// A pointer loaded before another store no longer matches.
+	stale, _ := m.LoadForUpdate("k")
+	other := 1
+	m.Store("k", &other)
+	if m.CompareAndSwap("k", stale, &zero) {
+		t.Fatal("CompareAndSwap succeeded with a stale pointer")
+	}
+}
+
+func TestSmallKVMap(t *testing.T) {
+	fill := func(n int) *KVMap[int, int] {
+		m := NewSmallKVMap[int, int]()
+		for i := 0; i < n; i++ {
+			i := i
+			m.Store(i, &i)
+		}
+		return m
+	}
+
+	t.Run("DrainInRange", func(t *testing.T) {
+		m := fill(10)
+		visited := 0
+		m.Range(func(k int, _ *int) bool {
+			m.Delete(k)
+			visited++
+			return true
+		})
+		if visited != 10 || m.Len() != 0 {
+			t.Fatalf("visited %d keys and left %d, want 10 and 0", visited, m.Len())
+		}
+	})
+
+	t.Run("ClearThenStore", func(t *testing.T) {
+		m := fill(5)
+		m.Clear()
+		one := 1
+		m.Store(7, &one)
+		if v, ok := m.Load(7); !ok || *v != 1 {
+			t.Fatalf("Load(7) = %v, %v after Clear and Store", v, ok)
+		}
+		if n := m.Len(); n != 1 {
+			t.Fatalf("Len() = %d, want 1", n)
+		}
+	})
+
+	t.Run("ReplaceAndDrain", func(t *testing.T) {
+		m := fill(5)
+		m.ReplaceAll(map[int]*int{})
+		two := 2
+		m.Store(2, &two)
+		if got := m.Len(); got != 1 {
+			t.Fatalf("Len() = %d after ReplaceAll and Store, want 1", got)
+		}
+
+		dst := make(map[int]*int)
+		m.DrainInto(dst)
+		if len(dst) != 1 || m.Len() != 0 {
+			t.Fatalf("DrainInto moved %d entries and left %d", len(dst), m.Len())
+		}
+		m.Store(3, &two)
+		if !m.Contains(3) {
+			t.Fatal("Store after DrainInto was lost")
+		}
+	})
+
+	t.Run("NoSnapshot", func(t *testing.T) {
+		promotions := 0
+		m := NewSmallKVMap[int, int]()
+		m.OnPromote = func(int) { promotions++ }
+		for i := 0; i < 10; i++ {
+			i := i
+			m.Store(i, &i)
+			m.Load(i)
+			m.Load(i)
+		}
+		m.Promote()
+		m.Range(func(int, *int) bool { return true })
+
+		if promotions != 0 {
+			t.Fatalf("OnPromote called %d times", promotions)
+		}
+		if !m.ContainsFast(3) {
+			t.Fatal("ContainsFast missed a present key")
+		}
+	})
+
+	t.Run("Sweep", func(t *testing.T) {
+		// Keys that come and go through CompareAndDelete must not pile up.
+		m := NewSmallKVMap[int, int]()
+		for i := 0; i < 10000; i++ {
+			i := i
+			m.Store(i, &i)
+			m.CompareAndDelete(i, &i)
+		}
+		if c := m.Cap(); c > 100 {
+			t.Fatalf("Cap() = %d after deleting every key", c)
+		}
+	})
+
+	t.Run("Fork", func(t *testing.T) {
+		m := fill(3)
+		f := m.Fork()
+		if !f.small {
+			t.Fatal("Fork of a small-mode map is in the default mode")
+		}
+		nine := 9
+		f.Store(0, &nine)
+		m.Delete(1)
+		if v, _ := m.Load(0); *v != 0 {
+			t.Fatalf("write to the fork leaked into the original: %d", *v)
+		}
+		if !f.Contains(1) {
+			t.Fatal("delete on the original leaked into the fork")
+		}
+	})
+}
@@ -0,0 +1,8 @@
+package sync
+
+// KV is a key-value pair, as returned by the functions that hand out several
+// entries of a map at once.
+type KV[K comparable, V any] struct {
+	Key   K
+	Value V
+}
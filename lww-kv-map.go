@@ -0,0 +1,110 @@
+package sync
+
+// LWWKVMap is a concurrent last-write-wins register map: every entry carries a
+// timestamp, and a write only takes effect if its timestamp is newer than the one
+// already stored for the key.
+//
+// It is meant for merging replicated state. Replicas exchange (key, value,
+// timestamp) triples and apply them with Merge in any order and any number of times,
+// and they all converge on the value with the highest timestamp for each key. Writes
+// with equal timestamps are decided by the tie-breaker passed to NewLWWKVMap, which
+// every replica must share. Deletions are merged the same way, as a nil value: the
+// key then keeps a tombstone with the deletion's timestamp, so that older writes
+// arriving later cannot bring it back. Tombstones are never removed.
+//
+// An LWWKVMap must be created with NewLWWKVMap and must not be copied after first
+// use. It is built on a KVMap, and merges are lock-free compare-and-swap loops for
+// keys already in its read-only snapshot.
+type LWWKVMap[K comparable, V any] struct {
+	tieBreak func(incoming, stored *V) bool
+	m        KVMap[K, stamped[V]]
+}
+
+// NewLWWKVMap returns an empty LWWKVMap that decides between writes with the same
+// timestamp with tieBreak, which reports whether incoming should replace stored.
+// Either may be nil for a deletion.
+//
+// Replicas only converge if tieBreak is a strict order on values: a deterministic
+// function of its arguments that, for any two different values, prefers exactly one
+// of them regardless of which is incoming, and that never prefers a value over an
+// equal one. If timestamps are unique, for instance because they embed a replica ID
+// in their lowest bits, any such function will do. NewLWWKVMap panics if tieBreak is
+// nil.
+func NewLWWKVMap[K comparable, V any](tieBreak func(incoming, stored *V) bool) *LWWKVMap[K, V] {
+	if tieBreak == nil {
+		panic("sync: NewLWWKVMap with nil tieBreak")
+	}
+
+	return &LWWKVMap[K, V]{tieBreak: tieBreak}
+}
+
+// stamped is a value of an LWWKVMap together with its timestamp. A nil value is a
+// tombstone.
+type stamped[V any] struct {
+	value *V
+	ts    int64
+}
+
+// Merge applies a write of value with timestamp ts to key, and reports whether it
+// took effect.
+//
+// The write is applied if the key has never been written, or if ts is greater than
+// the stored timestamp, or if the timestamps are equal and the tie-breaker prefers
+// value. A nil value deletes the key, leaving a tombstone. Merging the same write
+// twice is harmless: the second time, it loses the tie against itself.
+func (m *LWWKVMap[K, V]) Merge(key K, value *V, ts int64) (applied bool) {
+	next := &stamped[V]{value: value, ts: ts}
+
+	for {
+		cur, ok := m.m.Load(key)
+		if !ok {
+			if _, loaded := m.m.LoadOrStore(key, next); !loaded {
+				return true
+			}
+
+			continue
+		}
+
+		if !m.wins(next, cur) {
+			return false
+		}
+
+		if m.m.CompareAndSwap(key, cur, next) {
+			return true
+		}
+	}
+}
+
+// Load returns the value stored for key and its timestamp. If the key was never
+// written, it returns (nil, 0, false). If it was deleted, it returns nil, the
+// timestamp of the deletion and false.
+func (m *LWWKVMap[K, V]) Load(key K) (value *V, ts int64, ok bool) {
+	p, ok := m.m.Load(key)
+	if !ok {
+		return nil, 0, false
+	}
+
+	return p.value, p.ts, p.value != nil
+}
+
+// Range calls f sequentially for each live key, value and timestamp in the map,
+// skipping tombstones. If f returns false, the iteration stops. It has the same
+// semantics as KVMap.Range.
+func (m *LWWKVMap[K, V]) Range(f func(key K, value *V, ts int64) bool) {
+	m.m.Range(func(key K, p *stamped[V]) bool {
+		if p.value == nil {
+			return true
+		}
+
+		return f(key, p.value, p.ts)
+	})
+}
+
+// wins reports whether incoming should replace stored.
+func (m *LWWKVMap[K, V]) wins(incoming, stored *stamped[V]) bool {
+	if incoming.ts != stored.ts {
+		return incoming.ts > stored.ts
+	}
+
+	return m.tieBreak(incoming.value, stored.value)
+}
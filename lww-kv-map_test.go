@@ -0,0 +1,132 @@
+package sync
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// preferGreater breaks ties in favor of the greater value, with deletions losing.
+func preferGreater(incoming, stored *int) bool {
+	switch {
+	case incoming == nil:
+		return false
+	case stored == nil:
+		return true
+	default:
+		return *incoming > *stored
+	}
+}
+
+type lwwWrite struct {
+	key   string
+	value *int
+	ts    int64
+}
+
+func TestLWWKVMapConverges(t *testing.T) {
+	var writes []lwwWrite
+	for i := 0; i < 200; i++ {
+		var v *int
+		if i%5 != 0 {
+			n := i
+			v = &n
+		}
+
+		// Few distinct timestamps, so that ties are common.
+		writes = append(writes, lwwWrite{key: string(rune('a' + i%4)), value: v, ts: int64(i % 7)})
+	}
+
+	a := NewLWWKVMap[string, int](preferGreater)
+	b := NewLWWKVMap[string, int](preferGreater)
+	for _, w := range writes {
+		a.Merge(w.key, w.value, w.ts)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for _, i := range r.Perm(len(writes)) {
+		w := writes[i]
+		b.Merge(w.key, w.value, w.ts)
+		b.Merge(w.key, w.value, w.ts)
+	}
+
+	for _, k := range []string{"a", "b", "c", "d"} {
+		va, tsa, oka := a.Load(k)
+		vb, tsb, okb := b.Load(k)
+		if tsa != tsb || oka != okb || (oka && *va != *vb) {
+			t.Errorf("replicas diverged on %q: (%v, %d, %v) vs (%v, %d, %v)", k, va, tsa, oka, vb, tsb, okb)
+		}
+	}
+}
+
+func TestLWWKVMapTombstone(t *testing.T) {
+	m := NewLWWKVMap[string, int](preferGreater)
+	one := 1
+	if !m.Merge("k", nil, 10) {
+		t.Fatal("deletion of a new key not applied")
+	}
+	if m.Merge("k", &one, 5) {
+		t.Fatal("older write resurrected a deleted key")
+	}
+	if _, ts, ok := m.Load("k"); ok || ts != 10 {
+		t.Fatalf("Load = %d, %v; want tombstone at 10", ts, ok)
+	}
+
+	n := 0
+	m.Range(func(string, *int, int64) bool { n++; return true })
+	if n != 0 {
+		t.Fatalf("Range visited %d tombstones", n)
+	}
+}
+
+func TestNewLWWKVMapNilTieBreak(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("NewLWWKVMap(nil) did not panic")
+		}
+	}()
+	NewLWWKVMap[string, int](nil)
+}
+
+func TestLWWKVMapConcurrentMerge(t *testing.T) {
+	var writes []lwwWrite
+	for i := 0; i < 400; i++ {
+		var v *int
+		if i%5 != 0 {
+			n := i
+			v = &n
+		}
+		writes = append(writes, lwwWrite{key: string(rune('a' + i%4)), value: v, ts: int64(i % 7)})
+	}
+
+	want := NewLWWKVMap[string, int](preferGreater)
+	for _, w := range writes {
+		want.Merge(w.key, w.value, w.ts)
+	}
+
+	// Each goroutine applies every write in its own order, so that the writes
+	// interleave arbitrarily and are each applied several times.
+	got := NewLWWKVMap[string, int](preferGreater)
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		g := g
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for _, i := range r.Perm(len(writes)) {
+				w := writes[i]
+				got.Merge(w.key, w.value, w.ts)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, k := range []string{"a", "b", "c", "d"} {
+		vw, tsw, okw := want.Load(k)
+		vg, tsg, okg := got.Load(k)
+		if tsw != tsg || okw != okg || (okw && *vw != *vg) {
+			t.Errorf("concurrent merges diverged on %q: (%v, %d, %v) vs (%v, %d, %v)", k, vg, tsg, okg, vw, tsw, okw)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package sync
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// notifier wakes goroutines waiting for a condition on a map to become true. The
+// zero notifier is ready for use.
+//
+// Waiters register with add, then repeatedly take the current channel with wait,
+// check their condition, and block on the channel if it does not hold yet. Each
+// broadcast closes the current channel, so a change made after the check always
+// wakes the waiter. Broadcasting costs a single atomic load when nobody waits.
+type notifier struct {
+	waiters atomic.Int32
+
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// add registers (delta 1) or unregisters (delta -1) a waiter.
+func (n *notifier) add(delta int32) {
+	n.waiters.Add(delta)
+}
+
+// wait returns the channel closed by the next broadcast.
+func (n *notifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+
+	return n.ch
+}
+
+// broadcast wakes every waiter.
+func (n *notifier) broadcast() {
+	if n.waiters.Load() == 0 {
+		return
+	}
+
+	n.mu.Lock()
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+	n.mu.Unlock()
+}
@@ -0,0 +1,9 @@
+package sync
+
+// Number is the set of types the arithmetic helpers of this package work with:
+// the integer and floating-point types, and types based on them.
+type Number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64
+}
@@ -0,0 +1,59 @@
+package sync
+
+import "sync"
+
+// rangeParallel feeds the entries produced by rangeFn to a pool of workers calling
+// f. The first panic raised by f is re-raised once the pool has drained.
+func rangeParallel[K any, V any](workers int, rangeFn func(func(key K, value *V) bool), f func(key K, value *V)) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	type job struct {
+		key   K
+		value *V
+	}
+
+	jobs := make(chan job, workers)
+
+	var (
+		wg        sync.WaitGroup
+		panicOnce sync.Once
+		panicked  bool
+		panicVal  any
+	)
+
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+
+			for j := range jobs {
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							panicOnce.Do(func() {
+								panicked = true
+								panicVal = r
+							})
+						}
+					}()
+
+					f(j.key, j.value)
+				}()
+			}
+		}()
+	}
+
+	rangeFn(func(key K, value *V) bool {
+		jobs <- job{key: key, value: value}
+		return true
+	})
+
+	close(jobs)
+	wg.Wait()
+
+	if panicked {
+		panic(panicVal)
+	}
+}
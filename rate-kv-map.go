@@ -0,0 +1,69 @@
+package sync
+
+import "time"
+
+// RateKVMap is a fixed-window rate limiter keyed by K, such as a client address.
+//
+// Each key has a counter and the start of its current window. Allow counts a call
+// and refuses it once the key has used up its limit within the window; the first
+// call after the window has elapsed starts a new window with a fresh count. Windows
+// are per key and start with the key's first call, not at fixed wall-clock
+// boundaries.
+//
+// Counters are updated with compare-and-swap on a KVMap, so concurrent calls never
+// let more than limit calls through in one window. Keys are never dropped on their
+// own: a limiter facing an unbounded set of keys should Delete idle ones
+// periodically. The zero RateKVMap is ready for use and must not be copied after
+// first use.
+type RateKVMap[K comparable] struct {
+	m KVMap[K, rateWindow]
+}
+
+// rateWindow is the state of one key of a RateKVMap.
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// Allow counts a call for key and reports whether it is within limit calls per
+// window. A limit of zero or less refuses every call without recording it.
+//
+// The limit and window are taken from each call rather than fixed per map, so they
+// should be the same for every call on a given key; a call with a longer window
+// than the one that started the current window extends it.
+func (m *RateKVMap[K]) Allow(key K, limit int, window time.Duration) bool {
+	if limit <= 0 {
+		return false
+	}
+
+	for {
+		now := time.Now()
+		cur, ok := m.m.Load(key)
+
+		next := &rateWindow{start: now, count: 1}
+		if ok && now.Sub(cur.start) < window {
+			if cur.count >= limit {
+				return false
+			}
+
+			next = &rateWindow{start: cur.start, count: cur.count + 1}
+		}
+
+		if !ok {
+			if _, loaded := m.m.LoadOrStore(key, next); !loaded {
+				return true
+			}
+
+			continue
+		}
+
+		if m.m.CompareAndSwap(key, cur, next) {
+			return true
+		}
+	}
+}
+
+// Delete forgets the state of key, so that its next call starts a new window.
+func (m *RateKVMap[K]) Delete(key K) {
+	m.m.Delete(key)
+}
@@ -0,0 +1,59 @@
+package sync
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateKVMapWindow(t *testing.T) {
+	var m RateKVMap[string]
+	const window = 50 * time.Millisecond
+
+	for i := 0; i < 3; i++ {
+		if !m.Allow("a", 3, window) {
+			t.Fatalf("call %d within the limit refused", i)
+		}
+	}
+	if m.Allow("a", 3, window) {
+		t.Fatal("call over the limit allowed")
+	}
+	if !m.Allow("b", 3, window) {
+		t.Fatal("another key shares the limit of a")
+	}
+
+	time.Sleep(window + 10*time.Millisecond)
+	if !m.Allow("a", 3, window) {
+		t.Fatal("call after the window elapsed refused")
+	}
+
+	m.Delete("b")
+	if m.Allow("c", 0, window) {
+		t.Fatal("a zero limit allowed a call")
+	}
+}
+
+func TestRateKVMapConcurrent(t *testing.T) {
+	var (
+		m       RateKVMap[string]
+		allowed atomic.Int32
+		wg      sync.WaitGroup
+	)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if m.Allow("k", 25, time.Hour) {
+					allowed.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := allowed.Load(); n != 25 {
+		t.Fatalf("%d calls allowed in one window, want 25", n)
+	}
+}
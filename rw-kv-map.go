@@ -0,0 +1,244 @@
+package sync
+
+import "sync"
+
+// RWKVMap is a concurrent map with type-safe keys and values, backed by a plain Go
+// map guarded by a sync.RWMutex. It follows the conventions of KVMap: values are
+// stored as *V and a nil *V is treated as an absent value.
+//
+// RWKVMap has the core methods of KVMap, with the same signatures: Load, Store,
+// LoadOrStore, LoadAndDelete, Delete, Swap, CompareAndSwap, CompareAndDelete, Range
+// and Clear. Beyond those it only has RangeParallel, Rename and RangeSnapshot; the
+// rest of the KVMap API, and the package functions taking a *KVMap, are not
+// available for it.
+//
+// The zero RWKVMap is empty and ready for use. An RWKVMap must not be copied after
+// first use.
+//
+// KVMap is tuned for the workloads sync.Map is designed for: keys written once and
+// read many times, or goroutines working on disjoint key sets. Outside of those
+// patterns its bookkeeping can cost more than it saves. In particular, every Range
+// over a KVMap with pending writes promotes the dirty map, so workloads dominated
+// by full scans interleaved with inserts keep paying for that promotion. RWKVMap has
+// no such machinery: reads take a shared lock, writes take an exclusive lock, and
+// Range copies the entries under the shared lock. Prefer it when full scans are
+// interleaved with frequent inserts, or when writes to new keys are as common as
+// reads.
+type RWKVMap[K comparable, V any] struct {
+	mu sync.RWMutex
+	m  map[K]*V
+}
+
+// Load returns the value stored in the map for a key, or nil if no value is present.
+//
+// For RWKVMap[K,V]: 'key' is of type K. The ok result reports whether the key was
+// found. Load takes the read lock, so it only waits for writers.
+func (m *RWKVMap[K, V]) Load(key K) (value *V, ok bool) {
+	m.mu.RLock()
+	value, ok = m.m[key]
+	m.mu.RUnlock()
+
+	return value, ok
+}
+
+// Store sets the value for a key in the map.
+//
+// For RWKVMap[K,V]: 'key' is of type K, and 'value' is *V. As with KVMap, storing a
+// nil pointer removes the key.
+func (m *RWKVMap[K, V]) Store(key K, value *V) {
+	_, _ = m.Swap(key, value)
+}
+
+// Clear removes all key-value entries from the map.
+func (m *RWKVMap[K, V]) Clear() {
+	m.mu.Lock()
+	clear(m.m)
+	m.mu.Unlock()
+}
+
+// LoadOrStore returns the existing value for the key if present. Otherwise, it stores
+// and returns the given value. The loaded result is true if the value was already
+// present, false if the value was stored as a result of this call.
+//
+// For RWKVMap[K,V]: 'key' is K and 'value' is *V. A nil value is returned with
+// loaded == false but is not stored, matching the nil-as-absent convention.
+func (m *RWKVMap[K, V]) LoadOrStore(key K, value *V) (actual *V, loaded bool) {
+	m.mu.RLock()
+	actual, loaded = m.m[key]
+	m.mu.RUnlock()
+
+	if loaded {
+		return actual, true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if actual, loaded = m.m[key]; loaded {
+		return actual, true
+	}
+
+	m.storeLocked(key, value)
+
+	return value, false
+}
+
+// LoadAndDelete deletes the entry for a key, returning the value that was present and
+// a boolean indicating if the key was found.
+func (m *RWKVMap[K, V]) LoadAndDelete(key K) (value *V, loaded bool) {
+	m.mu.Lock()
+	value, loaded = m.m[key]
+	delete(m.m, key)
+	m.mu.Unlock()
+
+	return value, loaded
+}
+
+// Delete removes the entry for a key from the map.
+func (m *RWKVMap[K, V]) Delete(key K) {
+	m.LoadAndDelete(key)
+}
+
+// Swap swaps the existing value for a given key with a new value, and returns the previous value.
+//
+// For RWKVMap[K,V]: 'key' is K, 'value' is *V. The loaded result reports whether the key
+// was present. Swapping in a nil pointer deletes the key.
+func (m *RWKVMap[K, V]) Swap(key K, value *V) (previous *V, loaded bool) {
+	m.mu.Lock()
+	previous, loaded = m.m[key]
+	m.storeLocked(key, value)
+	m.mu.Unlock()
+
+	return previous, loaded
+}
+
+// CompareAndSwap swaps the old and new values for a key if the current value matches old.
+//
+// As with KVMap, the comparison is pointer equality, and an absent key never matches.
+func (m *RWKVMap[K, V]) CompareAndSwap(key K, old, new *V) (swapped bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if v, ok := m.m[key]; !ok || v != old {
+		return false
+	}
+
+	m.storeLocked(key, new)
+
+	return true
+}
+
+// CompareAndDelete deletes the entry for a key if its current value matches old.
+//
+// As with KVMap, the comparison is pointer equality, and an absent key never matches.
+func (m *RWKVMap[K, V]) CompareAndDelete(key K, old *V) (deleted bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if v, ok := m.m[key]; !ok || v != old {
+		return false
+	}
+
+	delete(m.m, key)
+
+	return true
+}
+
+// Range calls the given function sequentially for each key and value present in the map.
+// If f returns false, the iteration stops early.
+//
+// Range copies the entries under the read lock and calls f after releasing it, so f
+// may call any method of m, including ones that modify it, as with KVMap.Range. Each
+// call of f receives the value the key held when the copy was taken: a key deleted
+// or replaced by f or another goroutine in the meantime is still visited, with its
+// old value, and keys inserted during the iteration are not visited. The copy costs
+// one allocation of the map's size per call.
+func (m *RWKVMap[K, V]) Range(f func(key K, value *V) bool) {
+	m.mu.RLock()
+	entries := make([]KV[K, *V], 0, len(m.m))
+	for k, v := range m.m {
+		entries = append(entries, KV[K, *V]{Key: k, Value: v})
+	}
+	m.mu.RUnlock()
+
+	for _, e := range entries {
+		if !f(e.Key, e.Value) {
+			break
+		}
+	}
+}
+
+// RangeParallel calls f for each key and value present in the map, spreading the
+// calls across a pool of worker goroutines.
+//
+// It behaves like KVMap.RangeParallel. The entries are produced by Range, so f may
+// modify the map.
+func (m *RWKVMap[K, V]) RangeParallel(workers int, f func(key K, value *V)) {
+	rangeParallel(workers, m.Range, f)
+}
+
+// Rename moves the value stored under oldKey to newKey.
+//
+// It follows the rules of KVMap.Rename: the move only happens if oldKey holds a value
+// and newKey does not. Because every access to an RWKVMap takes the lock, no reader
+// ever observes the value under both keys or under neither.
+func (m *RWKVMap[K, V]) Rename(oldKey, newKey K) (moved bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	value, ok := m.m[oldKey]
+	if !ok {
+		return false
+	}
+
+	if _, ok := m.m[newKey]; ok {
+		return false
+	}
+
+	delete(m.m, oldKey)
+	m.m[newKey] = value
+
+	return true
+}
+
+// RangeSnapshot calls f sequentially for each key that was present in the map at
+// the moment RangeSnapshot was called. If f returns false, the iteration stops.
+//
+// It behaves like KVMap.RangeSnapshot: keys inserted after the snapshot are never
+// visited, values are reloaded before each call, and deleted keys are skipped. This
+// is where it differs from Range, which hands f the values as they were when the
+// iteration started.
+func (m *RWKVMap[K, V]) RangeSnapshot(f func(key K, value *V) bool) {
+	m.mu.RLock()
+	keys := make([]K, 0, len(m.m))
+	for k := range m.m {
+		keys = append(keys, k)
+	}
+	m.mu.RUnlock()
+
+	for _, k := range keys {
+		v, ok := m.Load(k)
+		if !ok {
+			continue
+		}
+
+		if !f(k, v) {
+			break
+		}
+	}
+}
+
+// storeLocked sets key to value, deleting it when value is nil. m.mu must be held
+// for writing.
+func (m *RWKVMap[K, V]) storeLocked(key K, value *V) {
+	if value == nil {
+		delete(m.m, key)
+		return
+	}
+
+	if m.m == nil {
+		m.m = make(map[K]*V)
+	}
+
+	m.m[key] = value
+}
@@ -0,0 +1,332 @@
+package sync
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// coreKVMap is the method set shared by KVMap and RWKVMap, exercised by the same
+// suite for both.
+type coreKVMap interface {
+	Load(key string) (*int, bool)
+	Store(key string, value *int)
+	LoadOrStore(key string, value *int) (*int, bool)
+	LoadAndDelete(key string) (*int, bool)
+	Delete(key string)
+	Swap(key string, value *int) (*int, bool)
+	CompareAndSwap(key string, old, new *int) bool
+	CompareAndDelete(key string, old *int) bool
+	Range(f func(key string, value *int) bool)
+	Clear()
+}
+
+func TestKVMapSuite(t *testing.T) {
+	testCoreKVMap(t, func() coreKVMap { return new(KVMap[string, int]) })
+}
+
+func TestSmallKVMapSuite(t *testing.T) {
+	testCoreKVMap(t, func() coreKVMap { return NewSmallKVMap[string, int]() })
+}
+
+func TestRWKVMapSuite(t *testing.T) {
+	testCoreKVMap(t, func() coreKVMap { return new(RWKVMap[string, int]) })
+}
+
+func testCoreKVMap(t *testing.T, newMap func() coreKVMap) {
+	t.Run("LoadStore", func(t *testing.T) {
+		m := newMap()
+		if _, ok := m.Load("a"); ok {
+			t.Fatal("Load on an empty map found a value")
+		}
+
+		one := 1
+		m.Store("a", &one)
+		if v, ok := m.Load("a"); !ok || v != &one {
+			t.Fatalf("Load(a) = %v, %v; want the stored pointer", v, ok)
+		}
+
+		m.Store("a", nil)
+		if _, ok := m.Load("a"); ok {
+			t.Fatal("Store(a, nil) did not delete a")
+		}
+	})
+
+	t.Run("LoadOrStore", func(t *testing.T) {
+		m := newMap()
+		one, two := 1, 2
+		if v, loaded := m.LoadOrStore("a", &one); loaded || v != &one {
+			t.Fatalf("first LoadOrStore = %v, %v", v, loaded)
+		}
+		if v, loaded := m.LoadOrStore("a", &two); !loaded || v != &one {
+			t.Fatalf("second LoadOrStore = %v, %v", v, loaded)
+		}
+		if v, loaded := m.LoadOrStore("b", nil); loaded || v != nil {
+			t.Fatalf("LoadOrStore(b, nil) = %v, %v", v, loaded)
+		}
+		if _, ok := m.Load("b"); ok {
+			t.Fatal("LoadOrStore stored a nil value")
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		m := newMap()
+		one := 1
+		m.Store("a", &one)
+		if v, loaded := m.LoadAndDelete("a"); !loaded || v != &one {
+			t.Fatalf("LoadAndDelete(a) = %v, %v", v, loaded)
+		}
+		if _, loaded := m.LoadAndDelete("a"); loaded {
+			t.Fatal("LoadAndDelete of a deleted key reported loaded")
+		}
+
+		m.Store("b", &one)
+		m.Delete("b")
+		if _, ok := m.Load("b"); ok {
+			t.Fatal("Delete(b) left b")
+		}
+	})
+
+	t.Run("Swap", func(t *testing.T) {
+		m := newMap()
+		one, two := 1, 2
+		if prev, loaded := m.Swap("a", &one); loaded || prev != nil {
+			t.Fatalf("Swap on an absent key = %v, %v", prev, loaded)
+		}
+		if prev, loaded := m.Swap("a", &two); !loaded || prev != &one {
+			t.Fatalf("Swap on a present key = %v, %v", prev, loaded)
+		}
+	})
+
+	t.Run("CompareAndSwap", func(t *testing.T) {
+		m := newMap()
+		one, two, other := 1, 2, 1
+		m.Store("a", &one)
+		if m.CompareAndSwap("a", &other, &two) {
+			t.Fatal("CompareAndSwap matched an equal but distinct pointer")
+		}
+		if !m.CompareAndSwap("a", &one, &two) {
+			t.Fatal("CompareAndSwap with the stored pointer failed")
+		}
+		if v, _ := m.Load("a"); v != &two {
+			t.Fatal("CompareAndSwap did not store the new value")
+		}
+		if m.CompareAndSwap("missing", nil, &one) {
+			t.Fatal("CompareAndSwap on an absent key succeeded")
+		}
+	})
+
+	t.Run("CompareAndDelete", func(t *testing.T) {
+		m := newMap()
+		one, other := 1, 1
+		m.Store("a", &one)
+		if m.CompareAndDelete("a", &other) {
+			t.Fatal("CompareAndDelete matched an equal but distinct pointer")
+		}
+		if !m.CompareAndDelete("a", &one) {
+			t.Fatal("CompareAndDelete with the stored pointer failed")
+		}
+		if _, ok := m.Load("a"); ok {
+			t.Fatal("CompareAndDelete left the key")
+		}
+	})
+
+	t.Run("RangeClear", func(t *testing.T) {
+		m := newMap()
+		for i := 0; i < 10; i++ {
+			i := i
+			m.Store(strconv.Itoa(i), &i)
+		}
+
+		seen := 0
+		m.Range(func(k string, v *int) bool {
+			if strconv.Itoa(*v) != k {
+				t.Errorf("Range: %s = %d", k, *v)
+			}
+			seen++
+			return true
+		})
+		if seen != 10 {
+			t.Fatalf("Range visited %d keys, want 10", seen)
+		}
+
+		seen = 0
+		m.Range(func(string, *int) bool {
+			seen++
+			return false
+		})
+		if seen != 1 {
+			t.Fatalf("Range visited %d keys after returning false, want 1", seen)
+		}
+
+		m.Clear()
+		m.Range(func(k string, _ *int) bool {
+			t.Errorf("Range after Clear visited %s", k)
+			return true
+		})
+	})
+
+	t.Run("MutateInRange", func(t *testing.T) {
+		m := newMap()
+		for i := 0; i < 10; i++ {
+			i := i
+			m.Store(strconv.Itoa(i), &i)
+		}
+
+		// f deletes every visited key and stores a replacement under a new one.
+		m.Range(func(k string, v *int) bool {
+			if strings.HasPrefix(k, "moved-") {
+				return true
+			}
+
+			m.Delete(k)
+			m.Store("moved-"+k, v)
+			return true
+		})
+
+		for i := 0; i < 10; i++ {
+			k := strconv.Itoa(i)
+			if _, ok := m.Load(k); ok {
+				t.Errorf("key %s survived its deletion inside Range", k)
+			}
+			if v, ok := m.Load("moved-" + k); !ok || *v != i {
+				t.Errorf("Load(moved-%s) = %v, %v", k, v, ok)
+			}
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		m := newMap()
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			w := w
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 500; i++ {
+					k := strconv.Itoa(i % 50)
+					v := w*1000 + i
+					m.Store(k, &v)
+					m.Load(k)
+					if i%7 == 0 {
+						m.Delete(k)
+					}
+					if i%50 == 0 {
+						m.Range(func(string, *int) bool { return true })
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+// benchmarkRangeHeavy runs full scans, with one insert of a new key after every
+// scansPerWrite of them.
+func benchmarkRangeHeavy(b *testing.B, m coreKVMap, scansPerWrite int) {
+	for i := 0; i < 1000; i++ {
+		i := i
+		m.Store(strconv.Itoa(i), &i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%scansPerWrite == 0 {
+			m.Store("k"+strconv.Itoa(i), &i)
+		}
+
+		m.Range(func(string, *int) bool { return true })
+	}
+}
+
+// BenchmarkRangeHeavy contrasts KVMap and RWKVMap when full scans are interleaved
+// with inserts. With frequent inserts, every KVMap scan promotes the dirty map and
+// RWKVMap wins; with rare ones, KVMap scans its read-only snapshot without locking
+// or copying it and comes out ahead.
+func BenchmarkRangeHeavy(b *testing.B) {
+	for _, scansPerWrite := range []int{1, 10, 1000} {
+		name := "ScansPerWrite=" + strconv.Itoa(scansPerWrite)
+		b.Run(name+"/KVMap", func(b *testing.B) {
+			benchmarkRangeHeavy(b, new(KVMap[string, int]), scansPerWrite)
+		})
+		b.Run(name+"/RWKVMap", func(b *testing.B) {
+			benchmarkRangeHeavy(b, new(RWKVMap[string, int]), scansPerWrite)
+		})
+	}
+}
+
+// BenchmarkLoadMostly contrasts the two maps under parallel reads of established
+// keys, the workload KVMap is built for.
+func BenchmarkLoadMostly(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		m    coreKVMap
+	}{
+		{"KVMap", new(KVMap[string, int])},
+		{"RWKVMap", new(RWKVMap[string, int])},
+	} {
+		m := bc.m
+		b.Run(bc.name, func(b *testing.B) {
+			keys := make([]string, 1000)
+			for i := range keys {
+				i := i
+				keys[i] = strconv.Itoa(i)
+				m.Store(keys[i], &i)
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					m.Load(keys[i%len(keys)])
+					i++
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkSmallMap contrasts the two modes of KVMap, with RWKVMap for reference, at
+// a handful of entries whose keys turn over, as in a table of in-flight requests:
+// each iteration inserts a new key, looks it up and deletes the oldest one. In the
+// default mode every insert takes the lock and, after each promotion, copies the
+// snapshot into a new dirty map, so at these sizes the small-map mode comes out
+// ahead.
+func BenchmarkSmallMap(b *testing.B) {
+	for _, size := range []int{1, 4, 16} {
+		size := size
+		for _, bc := range []struct {
+			name   string
+			newMap func() coreKVMap
+		}{
+			{"KVMap", func() coreKVMap { return new(KVMap[string, int]) }},
+			{"SmallKVMap", func() coreKVMap { return NewSmallKVMap[string, int]() }},
+			{"RWKVMap", func() coreKVMap { return new(RWKVMap[string, int]) }},
+		} {
+			bc := bc
+			b.Run("Entries="+strconv.Itoa(size)+"/"+bc.name, func(b *testing.B) {
+				keys := make([]string, b.N+size)
+				for i := range keys {
+					keys[i] = strconv.Itoa(i)
+				}
+
+				m := bc.newMap()
+				value := 0
+				for _, k := range keys[:size] {
+					m.Store(k, &value)
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					k := keys[i+size]
+					m.Store(k, &value)
+					m.Load(k)
+					m.Delete(keys[i])
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package sync
+
+// Set is a concurrent set of comparable elements, built on a KVMap with empty
+// values. It inherits the KVMap's performance profile: membership tests of
+// established elements are lock-free, and adding new elements takes the lock.
+//
+// The zero Set is empty and ready for use. A Set must not be copied after first use.
+type Set[K comparable] struct {
+	m KVMap[K, struct{}]
+}
+
+// member is the value stored for every element of a Set.
+var member struct{}
+
+// Add inserts k into the set and reports whether it was absent before.
+func (s *Set[K]) Add(k K) (added bool) {
+	_, loaded := s.m.LoadOrStore(k, &member)
+	return !loaded
+}
+
+// Remove deletes k from the set and reports whether it was present.
+func (s *Set[K]) Remove(k K) (removed bool) {
+	_, removed = s.m.LoadAndDelete(k)
+	return removed
+}
+
+// Contains reports whether k is in the set.
+func (s *Set[K]) Contains(k K) bool {
+	return s.m.Contains(k)
+}
+
+// Len returns the number of elements in the set. Like KVMap.Len, it is O(n).
+func (s *Set[K]) Len() int {
+	return s.m.Len()
+}
+
+// Range calls f sequentially for each element of the set. If f returns false, the
+// iteration stops. It has the same semantics as KVMap.Range.
+func (s *Set[K]) Range(f func(k K) bool) {
+	s.m.Range(func(k K, _ *struct{}) bool {
+		return f(k)
+	})
+}
+
+// Union returns a new set holding the elements that are in s, in other, or in both.
+//
+// Union, Intersect and Difference read their operands with Range and build the
+// result on the side, so they see each operand as Range does and never modify it.
+// The result is installed as the new set's read-only snapshot, so membership tests
+// on it are lock-free from the start.
+func (s *Set[K]) Union(other *Set[K]) *Set[K] {
+	elems := make(map[K]*entry[struct{}])
+	collect := func(k K) bool {
+		elems[k] = newEntry(&member)
+		return true
+	}
+
+	s.Range(collect)
+	other.Range(collect)
+
+	return newSet(elems)
+}
+
+// Intersect returns a new set holding the elements that are in both s and other.
+func (s *Set[K]) Intersect(other *Set[K]) *Set[K] {
+	elems := make(map[K]*entry[struct{}])
+	s.Range(func(k K) bool {
+		if other.Contains(k) {
+			elems[k] = newEntry(&member)
+		}
+
+		return true
+	})
+
+	return newSet(elems)
+}
+
+// Difference returns a new set holding the elements of s that are not in other.
+func (s *Set[K]) Difference(other *Set[K]) *Set[K] {
+	elems := make(map[K]*entry[struct{}])
+	s.Range(func(k K) bool {
+		if !other.Contains(k) {
+			elems[k] = newEntry(&member)
+		}
+
+		return true
+	})
+
+	return newSet(elems)
+}
+
+// newSet returns a set whose read-only snapshot is elems.
+func newSet[K comparable](elems map[K]*entry[struct{}]) *Set[K] {
+	s := &Set[K]{}
+	s.m.replaceLocked(elems)
+
+	return s
+}
@@ -0,0 +1,81 @@
+package sync
+
+import (
+	"slices"
+	"testing"
+)
+
+// newIntSet returns a set holding elems.
+func newIntSet(elems ...int) *Set[int] {
+	s := new(Set[int])
+	for _, e := range elems {
+		s.Add(e)
+	}
+
+	return s
+}
+
+// setElems returns the elements of s in ascending order.
+func setElems(s *Set[int]) []int {
+	var out []int
+	s.Range(func(k int) bool {
+		out = append(out, k)
+		return true
+	})
+	slices.Sort(out)
+
+	return out
+}
+
+func TestSetMembership(t *testing.T) {
+	var s Set[string]
+	if s.Contains("a") || s.Len() != 0 {
+		t.Fatal("zero Set is not empty")
+	}
+	if !s.Add("a") || s.Add("a") {
+		t.Fatal("Add did not report whether the element was new")
+	}
+	if !s.Contains("a") || s.Len() != 1 {
+		t.Fatalf("Contains(a) = %v, Len() = %d after Add", s.Contains("a"), s.Len())
+	}
+	if !s.Remove("a") || s.Remove("a") {
+		t.Fatal("Remove did not report whether the element was present")
+	}
+	if s.Contains("a") || s.Len() != 0 {
+		t.Fatal("element survived Remove")
+	}
+}
+
+func TestSetAlgebra(t *testing.T) {
+	a, b := newIntSet(1, 2, 3, 4), newIntSet(3, 4, 5)
+
+	for _, tc := range []struct {
+		name string
+		got  *Set[int]
+		want []int
+	}{
+		{"Union", a.Union(b), []int{1, 2, 3, 4, 5}},
+		{"Intersect", a.Intersect(b), []int{3, 4}},
+		{"Difference", a.Difference(b), []int{1, 2}},
+		{"DifferenceReversed", b.Difference(a), []int{5}},
+		{"IntersectEmpty", a.Intersect(new(Set[int])), nil},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if got := setElems(tc.got); !slices.Equal(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+			if n := tc.got.Len(); n != len(tc.want) {
+				t.Fatalf("Len() = %d, want %d", n, len(tc.want))
+			}
+		})
+	}
+
+	// The results are independent of their operands.
+	u := a.Union(b)
+	u.Add(9)
+	a.Remove(1)
+	if a.Contains(9) || !u.Contains(1) {
+		t.Fatal("Union result shares state with its operands")
+	}
+}
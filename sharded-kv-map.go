@@ -0,0 +1,116 @@
+package sync
+
+// ShardedKVMap spreads its entries over several independent KVMaps, chosen by a hash
+// of the key.
+//
+// Each shard has its own lock and dirty map, so write-heavy workloads that add many
+// new keys contend less than they would on a single KVMap, and each shard is promoted
+// separately. The shards are also a natural unit of parallelism for scans; see
+// RangeShards.
+//
+// A ShardedKVMap must be created with NewShardedKVMap and must not be copied after
+// first use.
+type ShardedKVMap[K comparable, V any] struct {
+	shards []KVMap[K, V]
+	hash   func(K) uint64
+}
+
+// NewShardedKVMap returns an empty ShardedKVMap with the given number of shards.
+//
+// hash maps a key to a shard; it must be deterministic, and spreading keys evenly
+// over the uint64 range keeps the shards balanced. A count below 1 is treated as 1.
+func NewShardedKVMap[K comparable, V any](shards int, hash func(K) uint64) *ShardedKVMap[K, V] {
+	if shards < 1 {
+		shards = 1
+	}
+
+	return &ShardedKVMap[K, V]{
+		shards: make([]KVMap[K, V], shards),
+		hash:   hash,
+	}
+}
+
+// shard returns the shard responsible for key.
+func (m *ShardedKVMap[K, V]) shard(key K) *KVMap[K, V] {
+	return &m.shards[m.hash(key)%uint64(len(m.shards))]
+}
+
+// Load returns the value stored for key, like KVMap.Load.
+func (m *ShardedKVMap[K, V]) Load(key K) (value *V, ok bool) {
+	return m.shard(key).Load(key)
+}
+
+// Store sets the value for key, like KVMap.Store.
+func (m *ShardedKVMap[K, V]) Store(key K, value *V) {
+	m.shard(key).Store(key, value)
+}
+
+// LoadOrStore returns the existing value for key or stores value, like
+// KVMap.LoadOrStore.
+func (m *ShardedKVMap[K, V]) LoadOrStore(key K, value *V) (actual *V, loaded bool) {
+	return m.shard(key).LoadOrStore(key, value)
+}
+
+// LoadAndDelete deletes the entry for key and returns its value, like
+// KVMap.LoadAndDelete.
+func (m *ShardedKVMap[K, V]) LoadAndDelete(key K) (value *V, loaded bool) {
+	return m.shard(key).LoadAndDelete(key)
+}
+
+// Delete removes the entry for key, like KVMap.Delete.
+func (m *ShardedKVMap[K, V]) Delete(key K) {
+	m.shard(key).Delete(key)
+}
+
+// Range calls f sequentially for each key and value in every shard, one shard after
+// the other. If f returns false, the iteration stops. Within a shard it has the
+// semantics of KVMap.Range; across shards there is no consistency guarantee at all.
+func (m *ShardedKVMap[K, V]) Range(f func(key K, value *V) bool) {
+	for i := range m.shards {
+		stopped := false
+		m.shards[i].Range(func(key K, value *V) bool {
+			if !f(key, value) {
+				stopped = true
+				return false
+			}
+
+			return true
+		})
+
+		if stopped {
+			return
+		}
+	}
+}
+
+// Shards returns the number of shards.
+func (m *ShardedKVMap[K, V]) Shards() int {
+	return len(m.shards)
+}
+
+// RangeShards calls f sequentially with the index and the KVMap of every shard. If f
+// returns false, the iteration stops.
+//
+// It exposes the shards for batch scans that want to work on them independently,
+// typically by handing each one to its own goroutine:
+//
+//	var wg sync.WaitGroup
+//	m.RangeShards(func(_ int, inner *KVMap[K, V]) bool {
+//		wg.Add(1)
+//		go func() {
+//			defer wg.Done()
+//			inner.Range(process)
+//		}()
+//		return true
+//	})
+//	wg.Wait()
+//
+// inner may be read and modified like any KVMap, but a key must only be stored in
+// the shard it hashes to, or the ShardedKVMap will not find it.
+func (m *ShardedKVMap[K, V]) RangeShards(f func(shard int, inner *KVMap[K, V]) bool) {
+	for i := range m.shards {
+		if !f(i, &m.shards[i]) {
+			return
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package sync
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShardedKVMap(t *testing.T) {
+	m := NewShardedKVMap[int, int](8, func(k int) uint64 { return uint64(k) })
+	for i := 0; i < 100; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+
+	if v, ok := m.Load(42); !ok || *v != 42 {
+		t.Fatalf("Load(42) = %v, %v", v, ok)
+	}
+	m.Delete(42)
+	if _, ok := m.Load(42); ok {
+		t.Fatal("Delete(42) left the key")
+	}
+
+	n := 0
+	m.Range(func(int, *int) bool { n++; return true })
+	if n != 99 {
+		t.Fatalf("Range visited %d keys, want 99", n)
+	}
+}
+
+func TestRangeShardsParallelSum(t *testing.T) {
+	m := NewShardedKVMap[int, int](8, func(k int) uint64 { return uint64(k) * 0x9E3779B97F4A7C15 })
+
+	var sequential int64
+	for i := 0; i < 1000; i++ {
+		i := i
+		m.Store(i, &i)
+		sequential += int64(i)
+	}
+
+	var parallel atomic.Int64
+	var wg sync.WaitGroup
+	shards := 0
+	m.RangeShards(func(_ int, inner *KVMap[int, int]) bool {
+		shards++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			inner.Range(func(_ int, v *int) bool {
+				parallel.Add(int64(*v))
+				return true
+			})
+		}()
+		return true
+	})
+	wg.Wait()
+
+	if shards != m.Shards() {
+		t.Fatalf("RangeShards visited %d shards, want %d", shards, m.Shards())
+	}
+	if got := parallel.Load(); got != sequential {
+		t.Fatalf("parallel sum over shards = %d, sequential sum = %d", got, sequential)
+	}
+}
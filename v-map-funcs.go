@@ -0,0 +1,110 @@
+package sync
+
+// CompareAndDeleteValue deletes the entry for a key if the value it currently holds
+// is equal to old.
+//
+// For VMap[V]: (m *VMap[V], key any, old V) -> (deleted bool).
+//
+// Unlike VMap.CompareAndDelete, which compares pointers, CompareAndDeleteValue
+// compares the pointed-to values with ==, so old does not need to be the pointer
+// that was stored. Under the hood it loads the current pointer, compares its content
+// and then deletes with CompareAndDelete, retrying if another goroutine replaced the
+// value in between. It returns false if the key is absent or its value differs.
+func CompareAndDeleteValue[T comparable](m *VMap[T], key any, old T) (deleted bool) {
+	for {
+		v, ok := m.Load(key)
+		if !ok || *v != old {
+			return false
+		}
+
+		if m.CompareAndDelete(key, v) {
+			return true
+		}
+	}
+}
+
+// EqualV reports whether two VMaps hold the same keys with equal values.
+//
+// Values are compared by content (with ==), not by pointer. Each map is read with
+// Range, so if either map is modified concurrently the result reflects some mix of
+// its states and is only meaningful once writers have settled.
+func EqualV[T comparable](a, b *VMap[T]) bool {
+	if a == b {
+		return true
+	}
+
+	sa, sb := a.snapshot(), b.snapshot()
+	if len(sa) != len(sb) {
+		return false
+	}
+
+	for k, va := range sa {
+		vb, ok := sb[k]
+		if !ok || *va != *vb {
+			return false
+		}
+	}
+
+	return true
+}
+
+// DiffV compares two VMaps and reports how new differs from old.
+//
+// added holds the keys present only in new, with their values from new. removed holds
+// the keys present only in old, with their values from old. changed holds the keys
+// present in both whose values differ by content; each element is {oldValue, newValue}.
+// Keys with equal values in both maps appear in none of the results.
+//
+// As with EqualV, both maps are read with Range and concurrent writers make the
+// result approximate.
+func DiffV[T comparable](old, new *VMap[T]) (added, removed map[any]*T, changed map[any][2]*T) {
+	so, sn := old.snapshot(), new.snapshot()
+
+	added = make(map[any]*T)
+	removed = make(map[any]*T)
+	changed = make(map[any][2]*T)
+
+	for k, vo := range so {
+		vn, ok := sn[k]
+		if !ok {
+			removed[k] = vo
+		} else if *vo != *vn {
+			changed[k] = [2]*T{vo, vn}
+		}
+	}
+
+	for k, vn := range sn {
+		if _, ok := so[k]; !ok {
+			added[k] = vn
+		}
+	}
+
+	return added, removed, changed
+}
+
+// AddV atomically adds delta to the value stored for key and returns the new value.
+//
+// For VMap[V]: (m *VMap[V], key any, delta V) -> V, where V is a Number.
+//
+// An absent key counts as zero, so the first AddV stores delta. Each addition stores
+// a freshly allocated value with CompareAndSwap (or LoadOrStore for an absent key)
+// and retries if another goroutine got there first, so no concurrent addition is
+// lost.
+func AddV[T Number](m *VMap[T], key any, delta T) T {
+	for {
+		old, ok := m.Load(key)
+		if !ok {
+			next := delta
+			if _, loaded := m.LoadOrStore(key, &next); !loaded {
+				return next
+			}
+
+			continue
+		}
+
+		next := *old + delta
+		if m.CompareAndSwap(key, old, &next) {
+			return next
+		}
+	}
+}
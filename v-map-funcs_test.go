@@ -0,0 +1,100 @@
+package sync
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCompareAndDeleteValue(t *testing.T) {
+	var m VMap[int]
+	stored := 5
+	m.Store("k", &stored)
+
+	if CompareAndDeleteValue(&m, "k", 6) {
+		t.Fatal("CompareAndDeleteValue with a different value deleted the key")
+	}
+	if CompareAndDeleteValue(&m, "missing", 5) {
+		t.Fatal("CompareAndDeleteValue of an absent key reported a delete")
+	}
+
+	// The comparison is by content, so a copy held elsewhere still matches.
+	fresh := new(int)
+	*fresh = 5
+	if !CompareAndDeleteValue(&m, "k", *fresh) {
+		t.Fatal("CompareAndDeleteValue with an equal value did not delete the key")
+	}
+	if _, ok := m.Load("k"); ok {
+		t.Fatal("key still present after CompareAndDeleteValue")
+	}
+}
+
+// newVMap returns a VMap holding a copy of entries.
+func newVMap[T any](entries map[any]T) *VMap[T] {
+	m := new(VMap[T])
+	for k, v := range entries {
+		v := v
+		m.Store(k, &v)
+	}
+
+	return m
+}
+
+func TestEqualV(t *testing.T) {
+	a := newVMap(map[any]int{1: 1, "1": 2, int64(1): 3})
+	b := newVMap(map[any]int{1: 1, "1": 2, int64(1): 3})
+	if !EqualV(a, b) || !EqualV(a, a) {
+		t.Fatal("EqualV of identical maps = false")
+	}
+
+	c := newVMap(map[any]int{1: 1, "1": 2, int64(1): 4})
+	if EqualV(a, c) {
+		t.Fatal("EqualV with a changed value = true")
+	}
+
+	d := newVMap(map[any]int{1: 1, "1": 2, int32(1): 3})
+	if EqualV(a, d) {
+		t.Fatal("EqualV with a different key set = true")
+	}
+}
+
+func TestDiffV(t *testing.T) {
+	old := newVMap(map[any]int{1: 1, "same": 2, "changed": 3, "removed": 4})
+	new := newVMap(map[any]int{1: 1, "same": 2, "changed": 30, int64(1): 5})
+
+	added, removed, changed := DiffV(old, new)
+	if len(added) != 1 || *added[int64(1)] != 5 {
+		t.Errorf("added = %v, want {int64(1): 5}", added)
+	}
+	if len(removed) != 1 || *removed["removed"] != 4 {
+		t.Errorf("removed = %v, want {removed: 4}", removed)
+	}
+	if c, ok := changed["changed"]; len(changed) != 1 || !ok || *c[0] != 3 || *c[1] != 30 {
+		t.Errorf("changed = %v, want {changed: {3, 30}}", changed)
+	}
+
+	added, removed, changed = DiffV(old, old)
+	if len(added)+len(removed)+len(changed) != 0 {
+		t.Errorf("DiffV of a map with itself = %v, %v, %v", added, removed, changed)
+	}
+}
+
+func TestAddVConcurrent(t *testing.T) {
+	var m VMap[int64]
+
+	const goroutines, adds = 8, 500
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < adds; j++ {
+				AddV(&m, "hits", 2)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v, ok := m.Load("hits"); !ok || *v != 2*goroutines*adds {
+		t.Fatalf("Load(hits) = %v, %v; want %d", v, ok, 2*goroutines*adds)
+	}
+}
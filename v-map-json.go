@@ -0,0 +1,40 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// UnmarshalJSONWith decodes a JSON object into the map, storing each member's value
+// under the key parseKey returns for the member's name.
+//
+// A VMap cannot implement json.Unmarshaler, because JSON object keys are strings and
+// the type of the original keys is lost; parseKey restores it, for example with
+// strconv.Atoi for int keys. It follows the rules of KVMap.UnmarshalJSON: members
+// are added to the existing contents, a null value deletes the key, and the whole
+// input is decoded and every key parsed before the map is touched, so on error the
+// map is left unchanged. Decoding errors and errors returned by parseKey wrap
+// ErrMalformedSnapshot. Two names that parse to the same key leave one of the
+// values, unspecified which.
+func (m *VMap[T]) UnmarshalJSONWith(data []byte, parseKey func(string) (any, error)) error {
+	var raw map[string]*T
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("%w: %w", ErrMalformedSnapshot, err)
+	}
+
+	entries := make(map[any]*T, len(raw))
+	for name, v := range raw {
+		key, err := parseKey(name)
+		if err != nil {
+			return fmt.Errorf("%w: key %q: %w", ErrMalformedSnapshot, name, err)
+		}
+
+		entries[key] = v
+	}
+
+	for k, v := range entries {
+		m.Store(k, v)
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package sync
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestVMapUnmarshalJSONWithIntKeys(t *testing.T) {
+	var m VMap[string]
+	stale := "stale"
+	m.Store(3, &stale)
+
+	parseInt := func(s string) (any, error) { return strconv.Atoi(s) }
+	if err := m.UnmarshalJSONWith([]byte(`{"1":"one","2":"two","3":null}`), parseInt); err != nil {
+		t.Fatalf("UnmarshalJSONWith() error = %v", err)
+	}
+
+	for k, want := range map[int]string{1: "one", 2: "two"} {
+		if v, ok := m.Load(k); !ok || *v != want {
+			t.Errorf("Load(%d) = %v, %v; want %q", k, v, ok, want)
+		}
+	}
+	if _, ok := m.Load("1"); ok {
+		t.Error("member stored under its string name instead of the parsed key")
+	}
+	if _, ok := m.Load(3); ok {
+		t.Error("null member did not delete key 3")
+	}
+}
+
+func TestVMapUnmarshalJSONWithStringKeys(t *testing.T) {
+	var m VMap[int]
+	identity := func(s string) (any, error) { return s, nil }
+	if err := m.UnmarshalJSONWith([]byte(`{"a":1,"b":2}`), identity); err != nil {
+		t.Fatalf("UnmarshalJSONWith() error = %v", err)
+	}
+
+	for k, want := range map[string]int{"a": 1, "b": 2} {
+		if v, ok := m.Load(k); !ok || *v != want {
+			t.Errorf("Load(%q) = %v, %v; want %d", k, v, ok, want)
+		}
+	}
+}
+
+func TestVMapUnmarshalJSONWithErrors(t *testing.T) {
+	parseInt := func(s string) (any, error) { return strconv.Atoi(s) }
+
+	for _, tc := range []struct {
+		name string
+		data string
+	}{
+		{"BadKey", `{"1":"one","x":"ex"}`},
+		{"BadValue", `{"1":"one","2":2}`},
+		{"NotAnObject", `["one"]`},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var m VMap[string]
+			err := m.UnmarshalJSONWith([]byte(tc.data), parseInt)
+			if !errors.Is(err, ErrMalformedSnapshot) {
+				t.Fatalf("UnmarshalJSONWith() error = %v, want %v", err, ErrMalformedSnapshot)
+			}
+			if !m.IsEmpty() {
+				t.Fatal("failed UnmarshalJSONWith modified the map")
+			}
+		})
+	}
+}
@@ -1,6 +1,10 @@
 package sync
 
 import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
 	"sync"
 	"sync/atomic"
 )
@@ -79,6 +83,69 @@ func (m *VMap[T]) Load(key any) (value *T, ok bool) {
 	return e.load()
 }
 
+// IsEmpty reports whether the map holds no live entries.
+//
+// IsEmpty returns false as soon as it finds a live entry in the read-only snapshot,
+// without locking. A snapshot that only holds deleted entries does not count as
+// non-empty: in that case, and when the snapshot is empty, the lock is only taken
+// if there are pending writes in the dirty map, which is then checked as well.
+func (m *VMap[T]) IsEmpty() bool {
+	read := m.loadReadOnly()
+	for _, e := range read.m {
+		if _, ok := e.load(); ok {
+			return false
+		}
+	}
+
+	if !read.amended {
+		return true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	read = m.loadReadOnly()
+	current := read.m
+	if read.amended {
+		current = m.dirty
+	}
+
+	for _, e := range current {
+		if _, ok := e.load(); ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// GetOrDefault returns the value stored for key, or def if the key is absent.
+//
+// For VMap[V]: 'key' is of type any and 'def' is *V.
+//
+// def is only returned, never stored. The lookup is the same as Load, so it does not
+// lock for keys in the read-only snapshot.
+func (m *VMap[T]) GetOrDefault(key any, def *T) *T {
+	if v, ok := m.Load(key); ok {
+		return v
+	}
+
+	return def
+}
+
+// Contains reports whether the map holds a value for key.
+//
+// For VMap[V]: 'key' is of type any. Keys of different dynamic types are distinct,
+// as in Load: a map holding int(1) does not contain int64(1).
+//
+// Contains is Load without the value. It never locks for keys in the read-only
+// snapshot, locks only when the key is missing from it and there are pending
+// writes, and reports false for deleted entries.
+func (m *VMap[T]) Contains(key any) bool {
+	_, ok := m.Load(key)
+	return ok
+}
+
 // Store sets the value for a key in the map.
 //
 // For VMap[V]: 'key' is of type any (interface{}), and 'value' is *V.
@@ -364,18 +431,32 @@ func (m *VMap[T]) CompareAndDelete(key any, old *T) (deleted bool) {
 		m.mu.Unlock()
 	}
 
-	for ok {
-		p := e.p.Load()
-		if p == nil || p == (*T)(expunged) || p != old {
+	return ok && e.tryCompareAndDelete(old)
+}
+
+// CompareAndSwapBy swaps in new for key if eq reports that the current value is equal
+// to old.
+//
+// For VMap[V]: (key any, old *V, new *V, eq func(a, b *V) bool) -> (swapped bool).
+//
+// It is CompareAndSwap with the pointer comparison replaced by eq, for value types
+// that cannot be compared with ==, or when old is a copy rather than the pointer
+// loaded from the map. eq is called with the current value and old. An absent key
+// never matches. A match is installed with CompareAndSwap against the pointer that
+// was compared, and if another goroutine replaced it in the meantime, the check is
+// repeated with the new value, so eq may be called several times and must not have
+// side effects.
+func (m *VMap[T]) CompareAndSwapBy(key any, old, new *T, eq func(a, b *T) bool) (swapped bool) {
+	for {
+		cur, ok := m.Load(key)
+		if !ok || !eq(cur, old) {
 			return false
 		}
 
-		if e.p.CompareAndSwap(p, nil) {
+		if m.CompareAndSwap(key, cur, new) {
 			return true
 		}
 	}
-
-	return false
 }
 
 // Range calls the given function sequentially for each key and value present in the map.
@@ -400,6 +481,11 @@ func (m *VMap[T]) CompareAndDelete(key any, old *T) (deleted bool) {
 // the map in ways that fundamentally disrupt the iteration (it’s okay to delete the current key or add new keys, but avoid patterns
 // like recursively calling Range within Range).
 //
+// Deleting every visited key from f (with Delete, LoadAndDelete or CompareAndDelete) is a supported way to drain
+// the map. Range iterates over an immutable snapshot of the keys that it promotes before the first call to f, and
+// deletions only mark entries as deleted without changing that snapshot, so every key present when Range started
+// is visited exactly once and the map is empty afterwards, apart from keys inserted by other goroutines meanwhile.
+//
 // If f panics, the panic propagates out of Range and the map's state is safe (no partial holds on locks).
 func (m *VMap[T]) Range(f func(key any, value *T) bool) {
 	read := m.loadReadOnly()
@@ -432,6 +518,212 @@ func (m *VMap[T]) Range(f func(key any, value *T) bool) {
 	}
 }
 
+// LoadMany returns the values stored in the map for several keys at once.
+//
+// For VMap[V]: 'keys' is a []any, and the result maps each key that was found to its
+// value. Keys that are absent (or hold a nil value) are left out of the result, so
+// len(result) < len(keys) signals that some keys were missing. Duplicate keys are
+// looked up once.
+//
+// Keys found in the read-only snapshot are served without locking. The lock is taken
+// at most once, for the keys that could only be in the dirty map, so LoadMany is
+// cheaper than calling Load in a loop when several keys miss the snapshot.
+func (m *VMap[T]) LoadMany(keys []any) map[any]*T {
+	result := make(map[any]*T, len(keys))
+
+	var missed []any
+
+	read := m.loadReadOnly()
+	for _, key := range keys {
+		e, ok := read.m[key]
+		if !ok {
+			if read.amended {
+				missed = append(missed, key)
+			}
+
+			continue
+		}
+
+		if v, ok := e.load(); ok {
+			result[key] = v
+		}
+	}
+
+	if len(missed) == 0 {
+		return result
+	}
+
+	m.mu.Lock()
+	for _, key := range missed {
+		read = m.loadReadOnly()
+		e, ok := read.m[key]
+		if !ok && read.amended {
+			e, ok = m.dirty[key]
+
+			m.missLocked()
+		}
+
+		if !ok {
+			continue
+		}
+
+		if v, ok := e.load(); ok {
+			result[key] = v
+		}
+	}
+	m.mu.Unlock()
+
+	return result
+}
+
+// RangeContext is like Range, but it stops early when ctx is done.
+//
+// For VMap[V]: f receives (key any, value *V).
+//
+// ctx is checked before each call to f. If it is cancelled or its deadline passes,
+// the iteration stops and RangeContext returns ctx.Err(). If f returns false, or all
+// entries have been visited, RangeContext returns nil. A call to f that is already
+// running is not interrupted; f should watch ctx itself if it does slow work.
+func (m *VMap[T]) RangeContext(ctx context.Context, f func(key any, value *T) bool) error {
+	var err error
+	m.Range(func(key any, value *T) bool {
+		if err = ctx.Err(); err != nil {
+			return false
+		}
+
+		return f(key, value)
+	})
+
+	return err
+}
+
+// NormalizeKeys rebuilds the map, replacing every key with norm(key).
+//
+// For VMap[V]: (norm func(any) any, merge ...func(key any, existing, incoming *V) *V).
+//
+// Because VMap keys are interfaces, values that look alike but have different
+// dynamic types, such as int(1) and int64(1), are distinct keys. NormalizeKeys lets
+// callers collapse such keys into a canonical form, for example by converting every
+// integer key to int64. norm must return a comparable value.
+//
+// When several keys normalize to the same key, their values are taken in a fixed
+// order: ascending by the name of the original key's dynamic type, then by its value
+// as formatted by fmt's %v, so that the outcome does not depend on map iteration
+// order. Without merge, the last value in that order wins; for int(1), int32(1) and
+// int64(1), that is the value of int64(1). With merge, which is optional and of
+// which only the first is used, each value after the first is combined with the one
+// kept so far: existing is that kept value, incoming the next one, and the result
+// is kept instead. A nil result deletes the key, and the next colliding value, if
+// any, is then kept as is, as if it were the first.
+//
+// NormalizeKeys holds the map's lock while it rebuilds, and norm and merge are called
+// with the lock held, so they must not call methods of m. Like Clear, it swaps in the
+// rebuilt contents in one step: a concurrent update of an existing key made while the
+// rebuild is in progress may be lost.
+func (m *VMap[T]) NormalizeKeys(norm func(key any) any, merge ...func(key any, existing, incoming *T) *T) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	read := m.loadReadOnly()
+	current := read.m
+	if read.amended {
+		current = m.dirty
+	}
+
+	type original struct {
+		key   any
+		value *T
+	}
+
+	groups := make(map[any][]original, len(current))
+	for k, e := range current {
+		if v, ok := e.load(); ok {
+			nk := norm(k)
+			groups[nk] = append(groups[nk], original{key: k, value: v})
+		}
+	}
+
+	entries := make(map[any]*entry[T], len(groups))
+	for nk, group := range groups {
+		if len(group) > 1 {
+			slices.SortFunc(group, func(a, b original) int {
+				if c := cmp.Compare(fmt.Sprintf("%T", a.key), fmt.Sprintf("%T", b.key)); c != 0 {
+					return c
+				}
+
+				return cmp.Compare(fmt.Sprint(a.key), fmt.Sprint(b.key))
+			})
+		}
+
+		var kept *T
+		for _, o := range group {
+			switch {
+			case kept == nil:
+				kept = o.value
+			case len(merge) > 0 && merge[0] != nil:
+				kept = merge[0](nk, kept, o.value)
+			default:
+				kept = o.value
+			}
+		}
+
+		if kept != nil {
+			entries[nk] = newEntry(kept)
+		}
+	}
+
+	m.read.Store(&readOnly[T]{m: entries})
+
+	m.dirty = nil
+	m.misses = 0
+}
+
+// RangeValues calls f sequentially for each key and a copy of its value. If f
+// returns false, the iteration stops.
+//
+// For VMap[V]: f receives (key any, value V).
+//
+// It is the VMap counterpart of KVMap.RangeValues: f gets a shallow copy of each
+// stored value, so changing it does not modify the map.
+func (m *VMap[T]) RangeValues(f func(key any, value T) bool) {
+	m.Range(func(key any, value *T) bool {
+		return f(key, *value)
+	})
+}
+
+// Keys returns the keys of all live entries, in unspecified order.
+//
+// Keys, Values and Entries are snapshots built with Range, so they share its
+// consistency notes. Each allocates its result with room for the entries of the
+// read-only snapshot.
+func (m *VMap[T]) Keys() []any {
+	keys := make([]any, 0, len(m.loadReadOnly().m))
+	m.Range(func(key any, _ *T) bool {
+		keys = append(keys, key)
+		return true
+	})
+
+	return keys
+}
+
+// Values returns the values of all live entries, in unspecified order. The pointers
+// are the stored ones, not copies.
+func (m *VMap[T]) Values() []*T {
+	values := make([]*T, 0, len(m.loadReadOnly().m))
+	m.Range(func(_ any, value *T) bool {
+		values = append(values, value)
+		return true
+	})
+
+	return values
+}
+
+// Entries returns the live entries of the map as a plain map. Modifying the result
+// does not affect the VMap.
+func (m *VMap[T]) Entries() map[any]*T {
+	return m.snapshot()
+}
+
 func (m *VMap[T]) missLocked() {
 	m.misses++
 	if m.misses < len(m.dirty) {
@@ -457,3 +749,14 @@ func (m *VMap[T]) dirtyLocked() {
 		}
 	}
 }
+
+// snapshot copies the live entries of the map into a plain map using Range.
+func (m *VMap[T]) snapshot() map[any]*T {
+	entries := make(map[any]*T, len(m.loadReadOnly().m))
+	m.Range(func(key any, value *T) bool {
+		entries[key] = value
+		return true
+	})
+
+	return entries
+}
@@ -0,0 +1,348 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestLoadMany(t *testing.T) {
+	var m VMap[string]
+	a, b, c := "int", "int64", "string"
+	m.Store(1, &a)
+	m.Store(int64(1), &b)
+	m.Store("1", &c)
+
+	got := m.LoadMany([]any{1, int64(1), "1", 2, int32(1), "missing"})
+	want := map[any]*string{1: &a, int64(1): &b, "1": &c}
+	if len(got) != len(want) {
+		t.Fatalf("LoadMany returned %d keys, want %d: %v", len(got), len(want), got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("LoadMany()[%#v] = %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestRangeContextCancel(t *testing.T) {
+	var m VMap[int]
+	for i := 0; i < 100; i++ {
+		i := i
+		m.Store(i, &i)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	visited := 0
+	err := m.RangeContext(ctx, func(any, *int) bool {
+		visited++
+		if visited == 10 {
+			cancel()
+		}
+		return true
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("RangeContext = %v, want context.Canceled", err)
+	}
+	if visited != 10 {
+		t.Fatalf("visited %d entries, want 10: the iteration must stop right after the cancel", visited)
+	}
+
+	visited = 0
+	if err := m.RangeContext(context.Background(), func(any, *int) bool {
+		visited++
+		return visited < 5
+	}); err != nil || visited != 5 {
+		t.Fatalf("RangeContext stopped by f = %v after %d entries, want nil after 5", err, visited)
+	}
+}
+
+// toInt64 normalizes integer keys of any width to int64.
+func toInt64(k any) any {
+	switch k := k.(type) {
+	case int:
+		return int64(k)
+	case int32:
+		return int64(k)
+	default:
+		return k
+	}
+}
+
+func TestNormalizeKeys(t *testing.T) {
+	var m VMap[int]
+	a, b, c, s := 1, 2, 4, 8
+	m.Store(1, &a)
+	m.Store(int64(1), &b)
+	m.Store(int32(1), &c)
+	m.Store("1", &s)
+
+	m.NormalizeKeys(toInt64, func(_ any, existing, incoming *int) *int {
+		sum := *existing + *incoming
+		return &sum
+	})
+
+	if v, ok := m.Load(int64(1)); !ok || *v != 7 {
+		t.Fatalf("Load(int64(1)) = %v, %v; want the merged 7", v, ok)
+	}
+	for _, k := range []any{1, int32(1)} {
+		if _, ok := m.Load(k); ok {
+			t.Errorf("key %T(%v) survived normalization", k, k)
+		}
+	}
+	if v, ok := m.Load("1"); !ok || v != &s {
+		t.Fatal("a key that normalizes to itself was not kept as is")
+	}
+	if n := len(m.snapshot()); n != 2 {
+		t.Fatalf("%d keys after normalization, want 2", n)
+	}
+
+	// Without merge the value of the key that sorts last by type name wins.
+	m.Store(1, &a)
+	m.Store(int32(1), &c)
+	m.NormalizeKeys(toInt64)
+	if v, ok := m.Load(int64(1)); !ok || *v != 7 {
+		t.Fatalf("Load(int64(1)) = %v, %v; want the value of int64(1)", v, ok)
+	}
+	m.Delete(int64(1))
+	m.Store(1, &a)
+	m.Store(int32(1), &c)
+	m.NormalizeKeys(toInt64)
+	if v, ok := m.Load(int64(1)); !ok || v != &c {
+		t.Fatalf("Load(int64(1)) = %v, %v; want the value of int32(1)", v, ok)
+	}
+}
+
+func TestNormalizeKeysMergeDrops(t *testing.T) {
+	var m VMap[int]
+	a, b, c := 1, 2, 4
+	m.Store(1, &a)
+	m.Store(int32(1), &b)
+	m.Store(int64(1), &c)
+
+	// The merge sees its inputs in type-name order, and a nil result deletes the key
+	// instead of being handed back as existing.
+	var calls [][2]int
+	m.NormalizeKeys(toInt64, func(_ any, existing, incoming *int) *int {
+		if existing == nil || incoming == nil {
+			t.Fatal("merge called with a nil value")
+		}
+		calls = append(calls, [2]int{*existing, *incoming})
+		if len(calls) == 1 {
+			return nil
+		}
+		return incoming
+	})
+
+	if want := [][2]int{{1, 2}}; !reflect.DeepEqual(calls, want) {
+		t.Fatalf("merge calls = %v, want %v", calls, want)
+	}
+	if v, ok := m.Load(int64(1)); !ok || v != &c {
+		t.Fatalf("Load(int64(1)) = %v, %v; want the value after the dropped merge", v, ok)
+	}
+
+	m.Store(1, &a)
+	m.NormalizeKeys(toInt64, func(any, *int, *int) *int { return nil })
+	if _, ok := m.Load(int64(1)); ok {
+		t.Fatal("a nil merge result did not delete the key")
+	}
+}
+
+func TestVMapRangeDeleteEveryKey(t *testing.T) {
+	var m VMap[int]
+	for i := 0; i < 1000; i++ {
+		i := i
+		m.Store(i, &i)
+		m.Store(strconv.Itoa(i), &i)
+	}
+
+	seen := make(map[any]int)
+	m.Range(func(k any, _ *int) bool {
+		seen[k]++
+		m.Delete(k)
+		return true
+	})
+
+	if len(seen) != 2000 {
+		t.Fatalf("visited %d keys, want 2000", len(seen))
+	}
+	for k, c := range seen {
+		if c != 1 {
+			t.Fatalf("key %v visited %d times", k, c)
+		}
+	}
+	if !m.IsEmpty() {
+		t.Fatal("map not empty after deleting every visited key")
+	}
+}
+
+func TestVMapRangeValuesCopies(t *testing.T) {
+	type point struct{ x, y int }
+
+	var m VMap[point]
+	m.Store("p", &point{1, 2})
+	m.Store(1, &point{3, 4})
+
+	visited := 0
+	m.RangeValues(func(_ any, p point) bool {
+		visited++
+		p.x = 100
+		return true
+	})
+
+	if visited != 2 {
+		t.Fatalf("RangeValues visited %d entries, want 2", visited)
+	}
+	if v, _ := m.Load("p"); v.x != 1 {
+		t.Fatalf("mutating the copy changed the stored value to %v", *v)
+	}
+}
+
+func TestVMapIsEmpty(t *testing.T) {
+	var m VMap[int]
+	if !m.IsEmpty() {
+		t.Fatal("IsEmpty() = false for a zero VMap")
+	}
+
+	for i := 0; i < 10; i++ {
+		i := i
+		m.Store(i, &i)
+		m.Store(strconv.Itoa(i), &i)
+	}
+	if m.IsEmpty() {
+		t.Fatal("IsEmpty() = true for a populated VMap")
+	}
+
+	// Promote the entries, then delete them all: only tombstones remain.
+	m.Range(func(any, *int) bool { return true })
+	for i := 0; i < 10; i++ {
+		m.Delete(i)
+		m.Delete(strconv.Itoa(i))
+	}
+	if !m.IsEmpty() {
+		t.Fatal("IsEmpty() = false when every entry is a tombstone")
+	}
+}
+
+func TestVMapGetOrDefault(t *testing.T) {
+	var m VMap[string]
+	v, def := "value", "default"
+	m.Store(1, &v)
+
+	if got := m.GetOrDefault(1, &def); got != &v {
+		t.Fatalf("GetOrDefault(1) = %v, want the stored value", *got)
+	}
+	for _, k := range []any{int64(1), "1", 2} {
+		if got := m.GetOrDefault(k, &def); got != &def {
+			t.Errorf("GetOrDefault(%T(%v)) = %v, want the default", k, k, *got)
+		}
+	}
+	if _, ok := m.Load(2); ok {
+		t.Fatal("GetOrDefault stored the default")
+	}
+}
+
+func TestVMapContains(t *testing.T) {
+	var m VMap[int]
+	v := 1
+	m.Store(1, &v)
+	m.Store("1", &v)
+
+	if !m.Contains(1) || !m.Contains("1") {
+		t.Fatal("Contains missed a present key")
+	}
+	if m.Contains(int64(1)) {
+		t.Fatal("Contains(int64(1)) matched the int key")
+	}
+
+	m.Delete("1")
+	if m.Contains("1") {
+		t.Fatal("Contains reported a deleted key")
+	}
+	if !m.Contains(1) {
+		t.Fatal("deleting one key type affected another")
+	}
+}
+
+func TestVMapSnapshots(t *testing.T) {
+	var m VMap[int]
+	a, b, c := 1, 2, 3
+	m.Store(1, &a)
+	m.Store(int64(1), &b)
+	m.Store("1", &c)
+	m.Store("gone", &c)
+	m.Delete("gone")
+
+	manual := make(map[any]*int)
+	m.Range(func(k any, v *int) bool {
+		manual[k] = v
+		return true
+	})
+
+	entries := m.Entries()
+	if len(entries) != len(manual) {
+		t.Fatalf("Entries() has %d keys, Range saw %d", len(entries), len(manual))
+	}
+	for k, v := range manual {
+		if entries[k] != v {
+			t.Errorf("Entries()[%T(%v)] = %v, Range saw %v", k, k, entries[k], v)
+		}
+	}
+
+	keys := m.Keys()
+	if len(keys) != len(manual) {
+		t.Fatalf("Keys() = %v, want the %d keys Range saw", keys, len(manual))
+	}
+	for _, k := range keys {
+		if _, ok := manual[k]; !ok {
+			t.Errorf("Keys() holds %T(%v), which Range did not see", k, k)
+		}
+	}
+
+	values := m.Values()
+	if len(values) != len(manual) {
+		t.Fatalf("Values() has %d values, want %d", len(values), len(manual))
+	}
+	found := make(map[*int]bool)
+	for _, v := range values {
+		found[v] = true
+	}
+	for _, v := range manual {
+		if !found[v] {
+			t.Errorf("Values() misses %d", *v)
+		}
+	}
+}
+
+func TestVMapCompareAndSwapBy(t *testing.T) {
+	// Slices cannot be compared with ==.
+	var m VMap[[]string]
+	eq := func(a, b *[]string) bool { return slices.Equal(*a, *b) }
+
+	stored := []string{"a", "b"}
+	m.Store("k", &stored)
+
+	differs := []string{"a", "c"}
+	next := []string{"x"}
+	if m.CompareAndSwapBy("k", &differs, &next, eq) {
+		t.Fatal("CompareAndSwapBy swapped on a different value")
+	}
+
+	copyOfStored := []string{"a", "b"}
+	if !m.CompareAndSwapBy("k", &copyOfStored, &next, eq) {
+		t.Fatal("CompareAndSwapBy with an equal copy did not swap")
+	}
+	if v, _ := m.Load("k"); v != &next {
+		t.Fatal("CompareAndSwapBy did not store new")
+	}
+
+	if m.CompareAndSwapBy("missing", &next, &stored, eq) {
+		t.Fatal("CompareAndSwapBy matched an absent key")
+	}
+}
@@ -0,0 +1,148 @@
+package sync
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// VersionedKVMap is a concurrent map whose entries carry a version number, for
+// optimistic concurrency control without comparing pointers.
+//
+// Every write assigns the entry a new version, taken from a counter shared by the
+// whole map, so versions only ever increase, both per key and across keys. A client
+// can read a value with its version, send both over the wire, and later apply an
+// update with CompareAndSwapVersion, which only succeeds if nobody wrote to the key
+// in the meantime. Version 0 is never assigned and stands for "absent".
+//
+// The zero VersionedKVMap is empty and ready for use. A VersionedKVMap must not be
+// copied after first use. It is built on a KVMap and shares its lock-free reads,
+// but writes are serialized by a mutex so that versions become visible in order.
+type VersionedKVMap[K comparable, V any] struct {
+	m     KVMap[K, versioned[V]]
+	clock atomic.Uint64
+
+	// wmu serializes writes, so that versions become visible in the order they
+	// are assigned. Reads do not take it.
+	wmu sync.Mutex
+}
+
+// versioned is a value of a VersionedKVMap together with its version.
+type versioned[V any] struct {
+	value   *V
+	version uint64
+}
+
+// Load returns the value stored for key and its version. If the key is absent, it
+// returns a nil value, version 0 and false.
+func (m *VersionedKVMap[K, V]) Load(key K) (value *V, version uint64, ok bool) {
+	p, ok := m.m.Load(key)
+	if !ok {
+		return nil, 0, false
+	}
+
+	return p.value, p.version, true
+}
+
+// Store sets the value for key and returns the version assigned to it. As with
+// KVMap.Store, a nil value deletes the key, in which case Store returns 0.
+func (m *VersionedKVMap[K, V]) Store(key K, value *V) (version uint64) {
+	if value == nil {
+		m.m.Delete(key)
+		return 0
+	}
+
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+
+	p := m.wrap(value)
+	m.m.Store(key, p)
+
+	return p.version
+}
+
+// Delete removes the entry for key.
+func (m *VersionedKVMap[K, V]) Delete(key K) {
+	m.m.Delete(key)
+}
+
+// CompareAndSwapVersion stores new for key if the entry's current version is
+// expectedVersion, and reports whether it did.
+//
+// An expectedVersion of 0 matches an absent key, so CompareAndSwapVersion can also be
+// used to create an entry only if it does not exist yet. A nil new deletes the entry
+// when the version matches. Every successful call assigns a new version, which can be
+// read back with Load.
+func (m *VersionedKVMap[K, V]) CompareAndSwapVersion(key K, expectedVersion uint64, new *V) (swapped bool) {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+
+	cur, ok := m.m.Load(key)
+	if !ok {
+		if expectedVersion != 0 || new == nil {
+			return false
+		}
+
+		_, loaded := m.m.LoadOrStore(key, m.wrap(new))
+
+		return !loaded
+	}
+
+	if cur.version != expectedVersion {
+		return false
+	}
+
+	if new == nil {
+		return m.m.CompareAndDelete(key, cur)
+	}
+
+	return m.m.CompareAndSwap(key, cur, m.wrap(new))
+}
+
+// Range calls f sequentially for each key, value and version present in the map. If
+// f returns false, the iteration stops. It has the same semantics as KVMap.Range.
+func (m *VersionedKVMap[K, V]) Range(f func(key K, value *V, version uint64) bool) {
+	m.m.Range(func(key K, p *versioned[V]) bool {
+		return f(key, p.value, p.version)
+	})
+}
+
+// RangeSince is like Range, but only visits entries whose version is greater than
+// version.
+//
+// It supports incremental replication. Take a checkpoint with Version before each
+// pass, and pass the checkpoint taken before the previous pass as version:
+//
+//	next := m.Version()
+//	m.RangeSince(last, replicate)
+//	last = next
+//
+// Every write with a version up to the checkpoint was visible when the pass started,
+// so it is either visited by this pass or was visited by an earlier one, and writes
+// made during the pass are picked up by the next one. Deletions are not reported,
+// and an entry rewritten since the checkpoint is visited once, with its latest value.
+// RangeSince still walks the whole map; it saves the work of processing unchanged
+// entries, not of iterating over them.
+func (m *VersionedKVMap[K, V]) RangeSince(version uint64, f func(key K, value *V, ver uint64) bool) {
+	m.m.Range(func(key K, p *versioned[V]) bool {
+		if p.version <= version {
+			return true
+		}
+
+		return f(key, p.value, p.version)
+	})
+}
+
+// Version returns the most recent version assigned by the map, or 0 if nothing was
+// written yet. Every write with a version up to the returned one is already visible
+// to readers.
+func (m *VersionedKVMap[K, V]) Version() uint64 {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+
+	return m.clock.Load()
+}
+
+// wrap pairs value with the next version. m.wmu must be held.
+func (m *VersionedKVMap[K, V]) wrap(value *V) *versioned[V] {
+	return &versioned[V]{value: value, version: m.clock.Add(1)}
+}
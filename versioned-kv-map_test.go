@@ -0,0 +1,69 @@
+package sync
+
+import "testing"
+
+func TestCompareAndSwapVersion(t *testing.T) {
+	var m VersionedKVMap[string, int]
+
+	one, two, three := 1, 2, 3
+	if !m.CompareAndSwapVersion("k", 0, &one) {
+		t.Fatal("CompareAndSwapVersion with version 0 failed to create the key")
+	}
+	_, stale, _ := m.Load("k")
+
+	fresh := m.Store("k", &two)
+	if fresh <= stale {
+		t.Fatalf("Store assigned version %d, not newer than %d", fresh, stale)
+	}
+
+	if m.CompareAndSwapVersion("k", stale, &three) {
+		t.Fatal("CompareAndSwapVersion with a stale version succeeded")
+	}
+	if v, _, _ := m.Load("k"); v != &two {
+		t.Fatal("a failed CompareAndSwapVersion changed the value")
+	}
+
+	if !m.CompareAndSwapVersion("k", fresh, &three) {
+		t.Fatal("CompareAndSwapVersion with the current version failed")
+	}
+	if v, ver, ok := m.Load("k"); !ok || v != &three || ver <= fresh {
+		t.Fatalf("Load = %v, %d, %v; want the new value with a newer version", v, ver, ok)
+	}
+
+	if m.CompareAndSwapVersion("k", 0, &one) {
+		t.Fatal("CompareAndSwapVersion with version 0 matched a present key")
+	}
+}
+
+func TestRangeSince(t *testing.T) {
+	var m VersionedKVMap[string, int]
+	for i, k := range []string{"a", "b", "c"} {
+		i := i
+		m.Store(k, &i)
+	}
+
+	checkpoint := m.Version()
+
+	d, b := 3, 10
+	m.Store("d", &d)
+	m.Store("b", &b)
+
+	seen := make(map[string]int)
+	m.RangeSince(checkpoint, func(k string, v *int, ver uint64) bool {
+		if ver <= checkpoint {
+			t.Errorf("RangeSince visited %s at version %d, not after %d", k, ver, checkpoint)
+		}
+		seen[k] = *v
+		return true
+	})
+
+	if len(seen) != 2 || seen["d"] != 3 || seen["b"] != 10 {
+		t.Fatalf("RangeSince visited %v, want only the rewritten b and the new d", seen)
+	}
+
+	n := 0
+	m.RangeSince(m.Version(), func(string, *int, uint64) bool { n++; return true })
+	if n != 0 {
+		t.Fatalf("RangeSince(Version()) visited %d entries, want 0", n)
+	}
+}
@@ -0,0 +1,84 @@
+//go:build go1.24
+
+package sync
+
+import (
+	"runtime"
+	"weak"
+)
+
+// WeakKVMap is a concurrent map that holds its values through weak pointers, so
+// storing a value does not keep it alive.
+//
+// Once the garbage collector reclaims a value, its key behaves as absent: Load
+// reports it missing and Range skips it. The entry itself is removed by a cleanup
+// registered with runtime.AddCleanup when the value is stored, and, in case that
+// has not run yet, by the first Load or Range that finds the value gone. This suits
+// caches that should give memory back under GC pressure, where some other part of
+// the program owns the values and the cache merely indexes them.
+//
+// The runtime does not guarantee that cleanups run, notably for zero-size values, so
+// some entries may only be pruned lazily.
+//
+// The zero WeakKVMap is empty and ready for use. A WeakKVMap must not be copied
+// after first use. It requires Go 1.24 or later.
+type WeakKVMap[K comparable, V any] struct {
+	m KVMap[K, weak.Pointer[V]]
+}
+
+// Load returns the value stored for key if it is still alive.
+func (m *WeakKVMap[K, V]) Load(key K) (value *V, ok bool) {
+	wp, ok := m.m.Load(key)
+	if !ok {
+		return nil, false
+	}
+
+	if value = wp.Value(); value == nil {
+		m.m.CompareAndDelete(key, wp)
+		return nil, false
+	}
+
+	return value, true
+}
+
+// Store sets the value for key without keeping value reachable. As with
+// KVMap.Store, a nil value deletes the key.
+func (m *WeakKVMap[K, V]) Store(key K, value *V) {
+	if value == nil {
+		m.m.Delete(key)
+		return
+	}
+
+	wp := weak.Make(value)
+	p := &wp
+	m.m.Store(key, p)
+
+	// The cleanup only drops the entry if it still holds this weak pointer, so a
+	// newer value stored under the same key is left alone.
+	runtime.AddCleanup(value, func(p *weak.Pointer[V]) {
+		m.m.CompareAndDelete(key, p)
+	}, p)
+}
+
+// Delete removes the entry for key.
+func (m *WeakKVMap[K, V]) Delete(key K) {
+	m.m.Delete(key)
+}
+
+// Range calls f sequentially for each key whose value is still alive. If f returns
+// false, the iteration stops. Entries whose value was collected are removed along
+// the way. It otherwise has the same semantics as KVMap.Range.
+//
+// The values passed to f are strong pointers: holding on to one keeps that value,
+// and its entry, alive.
+func (m *WeakKVMap[K, V]) Range(f func(key K, value *V) bool) {
+	m.m.Range(func(key K, wp *weak.Pointer[V]) bool {
+		value := wp.Value()
+		if value == nil {
+			m.m.CompareAndDelete(key, wp)
+			return true
+		}
+
+		return f(key, value)
+	})
+}
@@ -0,0 +1,33 @@
+//go:build go1.24
+
+package sync
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestWeakKVMapCollected(t *testing.T) {
+	var m WeakKVMap[string, large]
+
+	kept := &large{a: 1}
+	m.Store("kept", kept)
+	m.Store("dropped", &large{a: 2})
+
+	runtime.GC()
+	runtime.GC()
+
+	if v, ok := m.Load("kept"); !ok || v != kept {
+		t.Fatalf("Load(kept) = %v, %v; want the live value", v, ok)
+	}
+	if v, ok := m.Load("dropped"); ok {
+		t.Fatalf("Load(dropped) = %v after the value was collected", v)
+	}
+
+	n := 0
+	m.Range(func(string, *large) bool { n++; return true })
+	if n != 1 {
+		t.Fatalf("Range visited %d entries, want 1", n)
+	}
+	runtime.KeepAlive(kept)
+}